@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// loadMode is the go/packages load mode needed to resolve interfaces, their implementations
+// and their references. Only the packages of the project are parsed and type checked from
+// source, they share their type objects with each other. Dependencies outside the project,
+// including the standard library, are read from the export data the go tool caches, so the
+// Imports of a package only hold their IDs.
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles |
+	packages.NeedImports | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo
+
+// program holds the type checked packages of a project, including their test variants. A source file
+// compiled into a package and its test variant appears in both, with distinct type objects.
+type program struct {
+	cfg  *config
+	fset *token.FileSet
+	pkgs []*packages.Package
+}
+
+// loadProgram loads and type checks every package found in rootFolder and its sub folders, across the
+// modules of a workspace, together with their tests. Files rewritten in ov are loaded in their rewritten
+// state. The packages are ordered so that every package precedes the test variants. If any of the
+// packages contains errors or ctx is cancelled a nil program and an error are returned.
+func loadProgram(ctx context.Context, cfg *config, rootFolder string, ov *overlay) (*program, error) {
+	if debug {
+		fmt.Printf("main.loadProgram called: rootFolder: %s\n", rootFolder)
+		defer fmt.Printf("main.loadProgram returned\n")
+	}
+	contents, err := ov.contents()
+	if err != nil {
+		return nil, err
+	}
+	loadCfg := &packages.Config{
+		Context: ctx,
+		Mode:    loadMode,
+		Dir:     rootFolder,
+		Env:     cfg.env(),
+		Fset:    token.NewFileSet(),
+		Overlay: contents,
+		Tests:   true,
+	}
+	pkgs, err := packages.Load(loadCfg, loadPatterns(ctx, cfg, rootFolder)...)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range pkgs {
+		if len(pkg.Errors) > 0 {
+			return nil, fmt.Errorf("package %s: %s", pkg.PkgPath, pkg.Errors[0])
+		}
+	}
+	// the generated main packages running the tests hold no project files
+	var loaded []*packages.Package
+	for _, pkg := range pkgs {
+		if !strings.HasSuffix(pkg.ID, ".test") {
+			loaded = append(loaded, pkg)
+		}
+	}
+	sort.SliceStable(loaded, func(i, j int) bool {
+		return !isTestVariant(loaded[i]) && isTestVariant(loaded[j])
+	})
+	return &program{cfg: cfg, fset: loadCfg.Fset, pkgs: loaded}, nil
+}
+
+// isTestVariant reports whether pkg is a package recompiled with its test files, e.g. example.com/lib
+// [example.com/lib.test], or an external test package.
+func isTestVariant(pkg *packages.Package) bool {
+	return pkg.ID != pkg.PkgPath
+}
+
+// sameObject reports whether a and b are the same object, possibly taken from a package and its test
+// variant, which is the case if they are declared at the same position.
+func (p *program) sameObject(a, b types.Object) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil || a.Name() != b.Name() || !a.Pos().IsValid() || !b.Pos().IsValid() {
+		return false
+	}
+	pa, pb := p.fset.Position(a.Pos()), p.fset.Position(b.Pos())
+	return pa.Filename == pb.Filename && pa.Offset == pb.Offset
+}
+
+// packageObject returns the package level object obj as declared in the package of the project it
+// belongs to rather than in its test variant. Objects found in no package are returned unchanged.
+func (p *program) packageObject(obj types.Object) types.Object {
+	if obj.Pkg() == nil {
+		return obj
+	}
+	for _, pkg := range p.pkgs {
+		if isTestVariant(pkg) || pkg.PkgPath != obj.Pkg().Path() {
+			continue
+		}
+		if o := pkg.Types.Scope().Lookup(obj.Name()); o != nil && p.sameObject(o, obj) {
+			return o
+		}
+	}
+	return obj
+}
+
+// eachFile calls fn for every source file of the project once, together with its syntax tree and the
+// first package it belongs to.
+func (p *program) eachFile(fn func(pkg *packages.Package, f *ast.File, fp string)) {
+	seen := make(map[string]bool)
+	for _, pkg := range p.pkgs {
+		for _, f := range pkg.Syntax {
+			fp := p.fset.File(f.Pos()).Name()
+			if seen[fp] {
+				continue
+			}
+			seen[fp] = true
+			fn(pkg, f, fp)
+		}
+	}
+}
+
+// fileOf returns the package and the syntax tree of the file given by fp, taken from the package rather
+// than its test variant unless it is a test file. If the file is not part of any package nil values
+// are returned.
+func (p *program) fileOf(fp string) (*packages.Package, *ast.File) {
+	fp = filepath.Clean(fp)
+	for _, pkg := range p.pkgs {
+		for _, f := range pkg.Syntax {
+			if filepath.Clean(p.fset.File(f.Pos()).Name()) == fp {
+				return pkg, f
+			}
+		}
+	}
+	return nil, nil
+}
+
+// objectAt returns the object defined or used by the identifier found in the file given by fp
+// on row and col.
+func (p *program) objectAt(fp string, row, col int) (types.Object, error) {
+	pkg, f := p.fileOf(fp)
+	if f == nil {
+		return nil, fmt.Errorf("could not find file %s in any package", fp)
+	}
+	var obj types.Object
+	ast.Inspect(f, func(n ast.Node) bool {
+		if obj != nil {
+			return false
+		}
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		start := p.fset.Position(id.Pos())
+		if start.Line != row || col < start.Column || col >= start.Column+len(id.Name) {
+			return true
+		}
+		if obj = pkg.TypesInfo.Defs[id]; obj == nil {
+			obj = pkg.TypesInfo.Uses[id]
+		}
+		return false
+	})
+	if obj == nil {
+		return nil, fmt.Errorf("could not find an identifier in %s on row %d and column %d", fp, row, col)
+	}
+	return obj, nil
+}
+
+// refSpan returns the byte offsets of the start and the end of the reference ref in its file. A reference
+// qualified by a package name, e.g. lib.Singer, spans the package name as well.
+func (p *program) refSpan(ref reference) (int, int, error) {
+	tf, path, err := p.refPath(ref)
+	if err != nil {
+		return 0, 0, err
+	}
+	return tf.Offset(path[0].Pos()), tf.Offset(path[0].End()), nil
+}
+
+// isConversion reports whether the reference ref is the type of a conversion, e.g. lib.Singer(x), where
+// a pointer type replacing it has to be parenthesized.
+func (p *program) isConversion(ref reference) bool {
+	_, path, err := p.refPath(ref)
+	if err != nil || len(path) < 2 {
+		return false
+	}
+	call, ok := path[1].(*ast.CallExpr)
+	return ok && call.Fun == path[0]
+}
+
+// changedMeaning returns why replacing the interface referred to by ref with an implementation changes the
+// meaning of the code rather than just a type, or an empty string if it does not. This is the case for an
+// interface embedded in another interface and for the type of a type switch case or a type assertion.
+func (p *program) changedMeaning(ref reference) string {
+	_, path, err := p.refPath(ref)
+	if err != nil || len(path) < 2 {
+		return ""
+	}
+	switch parent := path[1].(type) {
+	case *ast.Field:
+		if len(parent.Names) > 0 || len(path) < 4 {
+			return ""
+		}
+		if _, ok := path[3].(*ast.InterfaceType); ok {
+			return "embedding an implementation turns the enclosing interface into a type constraint"
+		}
+	case *ast.CaseClause:
+		// only the case clauses of type switches list types
+		return "the type switch case would match the implementation only"
+	case *ast.TypeAssertExpr:
+		if parent.Type == path[0] {
+			return "the type assertion would succeed for the implementation only"
+		}
+	}
+	return ""
+}
+
+// refPath returns the file the reference ref is found in and the path of syntax nodes enclosing it, which
+// starts with the identifier of the reference or the selector qualifying it by a package name.
+func (p *program) refPath(ref reference) (*token.File, []ast.Node, error) {
+	_, f := p.fileOf(ref.filepath)
+	if f == nil {
+		return nil, nil, fmt.Errorf("could not find file %s in any package", ref.filepath)
+	}
+	tf := p.fset.File(f.Pos())
+	if ref.row < 1 || ref.row > tf.LineCount() {
+		return nil, nil, fmt.Errorf("row %d out of range in %s", ref.row, ref.filepath)
+	}
+	pos := tf.LineStart(ref.row) + token.Pos(ref.col-1)
+	path, _ := astutil.PathEnclosingInterval(f, pos, pos)
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("could not find a reference in %s on row %d and column %d", ref.filepath, ref.row, ref.col)
+	}
+	id, ok := path[0].(*ast.Ident)
+	if !ok {
+		return nil, nil, fmt.Errorf("could not find an identifier in %s on row %d and column %d", ref.filepath, ref.row, ref.col)
+	}
+	if len(path) > 1 {
+		if sel, ok := path[1].(*ast.SelectorExpr); ok && sel.Sel == id {
+			path = path[1:]
+		}
+	}
+	return tf, path, nil
+}
+
+// qualifier returns the name the file given by fp refers to the package target by, which is empty if the
+// file belongs to target or dot imports it. An existing import is respected together with its alias.
+// Otherwise the package name is returned, or an alias for it if the name is taken in the file, and
+// addImport is true. Imports already added to the file are passed in added keyed by import path.
+func (p *program) qualifier(fp string, target *types.Package, added map[string]string) (name string, addImport bool, err error) {
+	pkg, f := p.fileOf(fp)
+	if f == nil {
+		return "", false, fmt.Errorf("could not find file %s in any package", fp)
+	}
+	if pkg.PkgPath == target.Path() {
+		return "", false, nil
+	}
+	if name, ok := added[target.Path()]; ok {
+		return name, false, nil
+	}
+	taken := make(map[string]bool)
+	for _, name := range added {
+		taken[name] = true
+	}
+	for _, spec := range f.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		var name string
+		if spec.Name != nil {
+			name = spec.Name.Name
+		} else {
+			for _, imported := range pkg.Types.Imports() {
+				if imported.Path() == path {
+					name = imported.Name()
+				}
+			}
+		}
+		if path == target.Path() && name != "_" {
+			if name == "." {
+				return "", false, nil
+			}
+			return name, false, nil
+		}
+		taken[name] = true
+	}
+	name = target.Name()
+	for i := 1; taken[name] || pkg.Types.Scope().Lookup(name) != nil; i++ {
+		name = target.Name() + strconv.Itoa(i)
+	}
+	return name, true, nil
+}
+
+// uses returns the position of every identifier in the project, test files included, referring to obj,
+// sorted by filename, row and column.
+func (p *program) uses(obj types.Object) []token.Position {
+	var positions []token.Position
+	seen := make(map[token.Position]bool)
+	for _, pkg := range p.pkgs {
+		for id, o := range pkg.TypesInfo.Uses {
+			if !p.sameObject(o, obj) {
+				continue
+			}
+			pos := p.fset.Position(id.Pos())
+			if !seen[pos] {
+				seen[pos] = true
+				positions = append(positions, pos)
+			}
+		}
+	}
+	sortPositions(positions)
+	return positions
+}
+
+// renamedUses returns the positions of the uses of the type given by obj that renaming it changes,
+// which include the uses of the field names of structs embedding the type.
+func (p *program) renamedUses(obj types.Object) []token.Position {
+	positions := p.uses(obj)
+	for _, pkg := range p.pkgs {
+		for _, o := range pkg.TypesInfo.Defs {
+			field, ok := o.(*types.Var)
+			if !ok || !field.Embedded() || field.Name() != obj.Name() || field.Pkg() == nil || field.Pkg().Path() != obj.Pkg().Path() {
+				continue
+			}
+			positions = append(positions, p.uses(field)...)
+		}
+	}
+	sortPositions(positions)
+	return positions
+}
+
+// sortPositions sorts positions by filename, row and column.
+func sortPositions(positions []token.Position) {
+	sort.Slice(positions, func(i, j int) bool {
+		a, b := positions[i], positions[j]
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// interfaceAt returns the interface type name declared in the file given by fp on row and col.
+func (p *program) interfaceAt(fp string, row, col int) (*types.TypeName, *types.Interface, error) {
+	obj, err := p.objectAt(fp, row, col)
+	if err != nil {
+		return nil, nil, err
+	}
+	tn, ok := obj.(*types.TypeName)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not a type", obj.Name())
+	}
+	iface, ok := tn.Type().Underlying().(*types.Interface)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not an interface", tn.Name())
+	}
+	return tn, iface, nil
+}
+
+// implementations returns every package level concrete type in the project implementing iface,
+// either by value or by pointer, sorted by position. Types declared in test files or mock packages are
+// left out. Iface must be taken from a package rather than its test variant.
+func (p *program) implementations(iface *types.Interface) []*types.TypeName {
+	var impls []*types.TypeName
+	for _, pkg := range p.pkgs {
+		if isTestVariant(pkg) {
+			continue
+		}
+		scope := pkg.Types.Scope()
+		for _, name := range scope.Names() {
+			tn, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok || tn.IsAlias() {
+				continue
+			}
+			named, ok := tn.Type().(*types.Named)
+			if !ok || named.TypeParams().Len() > 0 || types.IsInterface(named) {
+				continue
+			}
+			if strings.HasSuffix(p.fset.Position(tn.Pos()).Filename, "_test.go") || p.cfg.isMock(pkg.PkgPath) {
+				continue
+			}
+			if types.Implements(named, iface) || types.Implements(types.NewPointer(named), iface) {
+				impls = append(impls, tn)
+			}
+		}
+	}
+	sort.Slice(impls, func(i, j int) bool {
+		a, b := p.fset.Position(impls[i].Pos()), p.fset.Position(impls[j].Pos())
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+	return impls
+}
+
+// implByIf finds the interface implementation for an interface given by the filepath, row and col arguments.
+// If implName is empty the interface must have exactly one implementation, otherwise the implementation
+// named implName is chosen among all the implementations. An implementation name may be qualified by its
+// package name, e.g. postgres.repo, to tell apart implementations with the same name.
+// If no implementation could be chosen it returns an error and a nil ifImplementation.
+func (p *program) implByIf(fp string, row, col int, implName string) (*ifImplementation, error) {
+	if debug {
+		fmt.Printf("main.implByIf called: fp: %s, row: %d, col %d, implName: %s\n", fp, row, col, implName)
+		defer fmt.Printf("main.implByIf returned\n")
+	}
+	tn, iface, err := p.interfaceAt(fp, row, col)
+	if err != nil {
+		return nil, err
+	}
+	impls := p.implementations(iface)
+	if len(impls) == 0 {
+		return nil, fmt.Errorf("no implementation of interface %s found", tn.Name())
+	}
+	if implName != "" {
+		var chosen []*types.TypeName
+		for _, impl := range impls {
+			if impl.Name() == implName || impl.Pkg().Name()+"."+impl.Name() == implName {
+				chosen = append(chosen, impl)
+			}
+		}
+		if len(chosen) == 0 {
+			return nil, fmt.Errorf("interface %s has no implementation named %s, found %s", tn.Name(), implName, implNames(impls))
+		}
+		impls = chosen
+	}
+	if len(impls) > 1 {
+		return nil, fmt.Errorf("Too many interface implementations of %s: %s, choose one with the impl option", tn.Name(), implNames(impls))
+	}
+	pos := p.fset.Position(impls[0].Pos())
+	return &ifImplementation{
+		filepath: pos.Filename,
+		name:     impls[0].Name(),
+		row:      pos.Line,
+		col:      pos.Column,
+	}, nil
+}
+
+// implNames returns the package qualified names of impls as a comma separated list.
+func implNames(impls []*types.TypeName) string {
+	names := make([]string, len(impls))
+	for i, impl := range impls {
+		names[i] = impl.Pkg().Name() + "." + impl.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+// implRefs finds references to the interface implementation declared in the file given by filepath
+// on row and col, test files included, together with the uses of the fields embedding it, which are
+// renamed along with it. It returns a nil slice and an error if an error occurs.
+func (p *program) implRefs(filepath string, row, col int) ([]ifImplementation, error) {
+	if debug {
+		fmt.Printf("main.implRefs called: filepath: %s, row: %d, col %d\n", filepath, row, col)
+		defer fmt.Printf("main.implRefs returned\n")
+	}
+	obj, err := p.objectAt(filepath, row, col)
+	if err != nil {
+		return nil, fmt.Errorf("could not get position from %s:%d.%d reference: %s", filepath, row, col, err)
+	}
+	var impls []ifImplementation
+	for _, pos := range p.renamedUses(obj) {
+		impls = append(impls, ifImplementation{
+			filepath: pos.Filename,
+			name:     obj.Name(),
+			row:      pos.Line,
+			col:      pos.Column,
+		})
+	}
+	return impls, nil
+}
+
+// ifRefs finds interface references, test files included. Filepath is the file the interface definition resides in
+// and row and col specifies the position in that file where the definition is located. If an error occurs
+// a nil slice and an error are returned.
+func (p *program) ifRefs(filepath string, row, col int) ([]reference, error) {
+	if debug {
+		fmt.Printf("main.ifRefs called: filepath: %s, row: %d, col %d\n", filepath, row, col)
+		defer fmt.Printf("main.ifRefs returned\n")
+	}
+	tn, _, err := p.interfaceAt(filepath, row, col)
+	if err != nil {
+		return nil, fmt.Errorf("could not get position from %s:%d.%d reference: %s", filepath, row, col, err)
+	}
+	var refs []reference
+	for _, pos := range p.uses(tn) {
+		refs = append(refs, reference{
+			filepath: pos.Filename,
+			row:      pos.Line,
+			col:      pos.Column,
+		})
+	}
+	return refs, nil
+}
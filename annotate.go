@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// posPattern matches the file position a compiler or vet diagnostic starts with, e.g. ./app/main.go:12:9:
+// or vet: ./app/main.go:12:9:. The output of the programs the go tool runs, e.g. log.Lshortfile positions,
+// indented test output and stack traces, already refers to the original source files through the //line
+// directives and is left alone.
+var posPattern = regexp.MustCompile(`^(?:vet: )?([^\s:]+\.go):(\d+):\d+:`)
+
+// annotator translates the file positions in the output of the go tool that refer to rewritten copies
+// of source files back to the original source files, while writing the output to w line by line. Each
+// error on a line changed by the rewrite is annotated with the noifgo tag that caused the change.
+type annotator struct {
+	r         *rewriter
+	w         io.Writer
+	wd        string
+	originals map[string][]byte
+	// copies maps the filepath of each rewritten copy to the filepath of its original
+	copies map[string]string
+	// changed holds the rows of each original source file changed by the rewrite
+	changed map[string]map[int]bool
+	// midLine is true if the output written last did not end with a line feed
+	midLine bool
+}
+
+// newAnnotator returns an annotator writing the annotated output to w, for the output of the go tool
+// run in the folder given by wd. If the rewritten files can not be read the output is written unchanged.
+func (r *rewriter) newAnnotator(w io.Writer, wd string) *annotator {
+	a := &annotator{r: r, w: w, wd: wd, copies: make(map[string]string), changed: make(map[string]map[int]bool)}
+	var err error
+	if a.originals, err = r.originals(); err != nil {
+		return a
+	}
+	if r.ov != nil {
+		for fp, copyFp := range r.ov.replace {
+			a.copies[copyFp] = fp
+		}
+	}
+	return a
+}
+
+// Write annotates and writes every line in p. The output following the last line feed is written right
+// away, e.g. a prompt of a program run by the go tool, and the rest of its line is left unannotated.
+func (a *annotator) Write(p []byte) (int, error) {
+	for written := 0; written < len(p); {
+		chunk := p[written:]
+		if i := bytes.IndexByte(chunk, '\n'); i != -1 {
+			chunk = chunk[:i+1]
+		}
+		line := string(chunk)
+		if !a.midLine {
+			line = a.annotate(line)
+		}
+		if _, err := io.WriteString(a.w, line); err != nil {
+			return written, err
+		}
+		a.midLine = chunk[len(chunk)-1] != '\n'
+		written += len(chunk)
+	}
+	return len(p), nil
+}
+
+// annotate returns line with the file position it starts with translated, followed by the causes of
+// the change on that position if it was changed by the rewrite.
+func (a *annotator) annotate(line string) string {
+	m := posPattern.FindStringSubmatchIndex(line)
+	if m == nil || a.originals == nil {
+		return line
+	}
+	fp := line[m[2]:m[3]]
+	row, _ := strconv.Atoi(line[m[4]:m[5]])
+	// the message names the renamed implementations the way they are named in the original source files
+	names := a.r.cfg.prefixedNames(line[m[1]:])
+	line = line[:m[1]] + a.r.cfg.stripImplPrefix(line[m[1]:])
+	abs := fp
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(a.wd, abs)
+	}
+	if orig, ok := a.copies[abs]; ok {
+		abs = orig
+		line = line[:m[2]] + relPath(a.wd, orig) + line[m[3]:]
+	}
+	var causes []string
+	if a.isChanged(abs, row) {
+		causes = a.r.causes(a.wd, abs, row, a.originals)
+	} else {
+		// an error on a row the rewrite left alone, e.g. a use of a renamed implementation, is caused by
+		// the rewrites renaming the implementations it names
+		seen := make(map[*taggedInterface]bool)
+		for _, name := range names {
+			for _, taggedIf := range a.r.renamedBy[name] {
+				if !seen[taggedIf] {
+					seen[taggedIf] = true
+					causes = append(causes, a.r.ifdefCause(a.wd, taggedIf, a.originals))
+				}
+			}
+		}
+	}
+	for _, cause := range causes {
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		line += fmt.Sprintf("\tcaused by %s\n", cause)
+	}
+	return line
+}
+
+// isChanged reports whether row of the original content of the file given by fp was changed by the
+// rewrite.
+func (a *annotator) isChanged(fp string, row int) bool {
+	original, ok := a.originals[fp]
+	if !ok {
+		return false
+	}
+	if a.changed[fp] == nil {
+		rewritten, err := a.r.ov.readFile(fp)
+		if err != nil {
+			return false
+		}
+		a.changed[fp] = changedRows(fp, original, rewritten)
+	}
+	return a.changed[fp][row]
+}
+
+// causes returns the noifgo tags that caused the change on row of the original content of the file
+// given by fp, found in originals. It is the reference tag on the row above, if any, otherwise the
+// noifgo:ifdef tag of each interface whose rewrite touched the file.
+func (r *rewriter) causes(wd, fp string, row int, originals map[string][]byte) []string {
+	lines := splitLines(originals[fp])
+	if row >= 2 && row-2 < len(lines) {
+		prev := lines[row-2]
+		if i := strings.Index(prev, "noifgo:{"); i != -1 {
+			if j := strings.Index(prev[i:], "}"); j != -1 {
+				return []string{fmt.Sprintf("//%s at %s:%d", prev[i:i+j+1], relPath(wd, fp), row-1)}
+			}
+		}
+	}
+	var causes []string
+	for _, taggedIf := range r.rewrittenBy[fp] {
+		causes = append(causes, r.ifdefCause(wd, taggedIf, originals))
+	}
+	return causes
+}
+
+// ifdefCause returns the noifgo:ifdef tag of taggedIf as a cause, positioned in the original content of
+// its file found in originals.
+func (r *rewriter) ifdefCause(wd string, taggedIf *taggedInterface, originals map[string][]byte) string {
+	ifdefRow := taggedIf.row - 1
+	ifOriginal, ok := originals[taggedIf.filepath]
+	if !ok {
+		ifOriginal, _ = r.ov.readFile(taggedIf.filepath)
+	}
+	if origRow := ifdefRowOf(ifOriginal, taggedIf.name); origRow != 0 {
+		ifdefRow = origRow
+	}
+	return fmt.Sprintf("//noifgo:ifdef of %s at %s:%d", taggedIf.name, relPath(wd, taggedIf.filepath), ifdefRow)
+}
+
+// ifdefRowOf returns the row of the noifgo:ifdef tag in src tagging the interface given by name, or 0
+// if there is none.
+func ifdefRowOf(src []byte, name string) int {
+	lines := splitLines(src)
+	for i := 0; i+1 < len(lines); i++ {
+		if strings.Contains(lines[i], string(ifdefTag)) && strings.Contains(lines[i+1], " "+name+" ") {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// changedRows returns the rows of original that the lines changed or inserted by the rewrite into
+// rewritten stand for as mapped by mapRows, ignoring the //line directives added to the file given by fp.
+func changedRows(fp string, original, rewritten []byte) map[int]bool {
+	var lines []string
+	for _, line := range splitLines(rewritten) {
+		if !strings.HasPrefix(line, "//line "+fp+":") {
+			lines = append(lines, line)
+		}
+	}
+	rows := make(map[int]bool)
+	origRows, changed := mapRows(splitLines(original), lines)
+	for i, row := range origRows {
+		if changed[i] {
+			rows[row] = true
+		}
+	}
+	return rows
+}
+
+// relPath returns fp relative to the folder given by wd in the form the go tool prints positions in.
+func relPath(wd, fp string) string {
+	rel, err := filepath.Rel(wd, fp)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fp
+	}
+	return "." + string(filepath.Separator) + rel
+}
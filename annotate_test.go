@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestChangedRows(t *testing.T) {
+	tests := []struct {
+		name                string
+		original, rewritten string
+		want                map[int]bool
+	}{
+		{
+			name:      "replace",
+			original:  "a\nvar s Singer = New()\nif s == nil {\n",
+			rewritten: "a\nvar s impl = New()\nif s == nil {\n",
+			want:      map[int]bool{2: true},
+		},
+		{
+			name:      "pure insert",
+			original:  "a\nb\n",
+			rewritten: "a\nx\n//line f.go:2:1\nb\n",
+			want:      map[int]bool{2: true},
+		},
+		{
+			name:      "multi-line replace",
+			original:  "a\nx = s.Area()\nc\n",
+			rewritten: "a\nif ok {\n//line f.go:2:1\n\tx = c.Area()\n//line f.go:2:1\n}\nc\n",
+			want:      map[int]bool{2: true},
+		},
+		{
+			name:      "delete",
+			original:  "a\nb\nc\n",
+			rewritten: "a\n//line f.go:3:1\nc\n",
+			want:      map[int]bool{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changedRows("f.go", []byte(tt.original), []byte(tt.rewritten)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changedRows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnotateRenamedImplementation(t *testing.T) {
+	root := writeProject(t, map[string]string{
+		"lib/lib.go": "package lib\n\n//noifgo:ifdef\ntype Shape interface{ Area() int }\n\n" +
+			"type sq struct{}\n\nfunc (sq) Area() int { return 1 }\n\n" +
+			"//noifgo:{Shape,v}\nfunc New(ok bool) Shape {\n\tif ok {\n\t\treturn sq{}\n\t}\n\treturn nil\n}\n",
+	})
+	cfg, err := readConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ann, err := rewriteInOverlay(context.Background(), cfg, root, root)
+	if err != nil {
+		t.Fatalf("rewriteInOverlay() error = %v", err)
+	}
+	defer r.ov.remove()
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			name: "unchanged row naming the implementation",
+			line: "lib/lib.go:15:9: cannot use nil as NoIFGosq value in return statement\n",
+			want: "lib/lib.go:15:9: cannot use nil as sq value in return statement\n" +
+				"\tcaused by //noifgo:ifdef of Shape at ./lib/lib.go:3\n",
+		},
+		{
+			name: "changed row",
+			line: "lib/lib.go:11:6: New redeclared in this block\n",
+			want: "lib/lib.go:11:6: New redeclared in this block\n\tcaused by //noifgo:{Shape,v} at ./lib/lib.go:10\n",
+		},
+		{
+			name: "unchanged row",
+			line: "lib/lib.go:12:5: undefined: ok\n",
+			want: "lib/lib.go:12:5: undefined: ok\n",
+		},
+		{
+			name: "program output",
+			line: "main.go:15: NoIFGosq\n",
+			want: "main.go:15: NoIFGosq\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ann.annotate(tt.line); got != tt.want {
+				t.Errorf("annotate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const helpBench = `Usage:
+
+	noifgo bench [-bench regexp] [-count n] [-benchtime t] [packages]
+
+Bench runs the benchmarks of the packages, first on the untouched source files and then on the source
+files with every tagged interface rewritten the same way a build does, and prints a table comparing
+the time, the bytes allocated and the allocations per operation of each benchmark between the two
+runs. Without packages every package of the project is benchmarked. The source files are left
+untouched.
+
+Each value is the mean of the runs of the benchmark followed by the largest deviation from it. The
+delta is printed if a Mann-Whitney U test finds the difference significant, with a p-value below
+0.05, and is replaced by ~ otherwise. It is followed by the p-value and the number of runs before and
+after the rewrite.
+
+The flags are:
+
+	-bench regexp
+		run only the benchmarks matching regexp, as with go test. The default is
+		every benchmark.
+	-count n
+		run each benchmark n times on each code. The default is 10, fewer runs
+		make the significance test unreliable.
+	-benchtime t
+		run each benchmark for the duration t or the number of iterations t, as
+		with go test.
+
+`
+
+// benchAlpha is the significance level below which a delta is considered significant.
+const benchAlpha = 0.05
+
+// benchKey identifies a measurement of a benchmark given by its package, its name and the unit of the
+// measurement, e.g. ns/op.
+type benchKey struct {
+	pkg, name, unit string
+}
+
+// benchRun holds the measurements of a run of benchmarks together with the keys in the order they were
+// first measured.
+type benchRun struct {
+	keys   []benchKey
+	values map[benchKey][]float64
+}
+
+// bench implements the "noifgo bench" command.
+func bench(ctx context.Context, cfg *config, rootFolder string, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Printf(helpBench)
+	}
+	benchRe := fs.String("bench", ".", "Regular expression selecting the benchmarks to run.")
+	count := fs.Int("count", 10, "Number of times to run each benchmark.")
+	benchtime := fs.String("benchtime", "", "Duration or number of iterations of each benchmark run.")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if *count < 1 {
+		return errors.New("count must be at least 1")
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	pkgs := fs.Args()
+	if len(pkgs) == 0 {
+		dir = rootFolder
+		pkgs = loadPatterns(ctx, cfg, rootFolder)
+	}
+	testArgs := []string{"-run=^$", "-bench=" + *benchRe, "-count=" + strconv.Itoa(*count), "-benchmem"}
+	if *benchtime != "" {
+		testArgs = append(testArgs, "-benchtime="+*benchtime)
+	}
+	testArgs = append(testArgs, pkgs...)
+
+	fmt.Fprintf(os.Stderr, "Benchmarking the original code\n")
+	before, err := runBenchmarks(ctx, cfg, dir, nil, nil, testArgs)
+	if err != nil {
+		return err
+	}
+	if len(before.keys) == 0 {
+		return errors.New("no benchmarks found")
+	}
+
+	r, ann, err := rewriteInOverlay(ctx, cfg, rootFolder, dir)
+	if err != nil {
+		return err
+	}
+	defer r.ov.remove()
+	fmt.Fprintf(os.Stderr, "Benchmarking the rewritten code\n")
+	after, err := runBenchmarks(ctx, cfg, dir, r.ov, ann, testArgs)
+	if err != nil {
+		return err
+	}
+	printBenchTable(before, after)
+	return nil
+}
+
+// runBenchmarks runs go test with args in the folder dir, on the source files rewritten in ov if ov is
+// not nil, and returns the measurements of the benchmarks run. If go test fails its output is returned
+// in the error, translated by ann unless it is nil.
+func runBenchmarks(ctx context.Context, cfg *config, dir string, ov *overlay, ann *annotator, args []string) (*benchRun, error) {
+	testArgs := []string{"test"}
+	if ov != nil {
+		overlayFp, err := ov.writeJSON()
+		if err != nil {
+			return nil, fmt.Errorf("could not write overlay: %s", err)
+		}
+		testArgs = append(testArgs, "-overlay="+overlayFp)
+	}
+	cmd := exec.CommandContext(ctx, cfg.goBinary(), append(testArgs, args...)...)
+	cmd.Dir = dir
+	cmd.Env = cfg.env()
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, errors.New("Interrupted")
+	}
+	if err != nil {
+		var failure strings.Builder
+		for _, line := range splitLines(out) {
+			if ann != nil {
+				line = ann.annotate(line)
+			}
+			failure.WriteString(line)
+		}
+		return nil, fmt.Errorf("go test failed: %s\n%s", err, strings.TrimRight(failure.String(), "\n"))
+	}
+
+	run := &benchRun{values: make(map[benchKey][]float64)}
+	var pkg string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "pkg: ") {
+			pkg = strings.TrimPrefix(line, "pkg: ")
+			continue
+		}
+		// e.g. BenchmarkSing-8   1000000   30.51 ns/op   0 B/op   0 allocs/op
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		name := strings.TrimPrefix(fields[0], "Benchmark")
+		for i := 2; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				break
+			}
+			key := benchKey{pkg: pkg, name: name, unit: fields[i+1]}
+			if _, ok := run.values[key]; !ok {
+				run.keys = append(run.keys, key)
+			}
+			run.values[key] = append(run.values[key], v)
+		}
+	}
+	return run, nil
+}
+
+// printBenchTable prints the measurements of the benchmarks in before and after side by side, a table
+// for each package and unit.
+func printBenchTable(before, after *benchRun) {
+	var pkgs, units []string
+	seenPkgs, seenUnits := make(map[string]bool), make(map[string]bool)
+	for _, key := range before.keys {
+		if !seenPkgs[key.pkg] {
+			seenPkgs[key.pkg] = true
+			pkgs = append(pkgs, key.pkg)
+		}
+		if !seenUnits[key.unit] {
+			seenUnits[key.unit] = true
+			units = append(units, key.unit)
+		}
+	}
+	// the standard units come first as in benchstat
+	order := map[string]int{"ns/op": 1, "B/op": 2, "allocs/op": 3}
+	sort.SliceStable(units, func(i, j int) bool {
+		oi, oj := order[units[i]], order[units[j]]
+		if oi == 0 || oj == 0 {
+			return oi != 0 && oj == 0
+		}
+		return oi < oj
+	})
+
+	for _, pkg := range pkgs {
+		if pkg != "" {
+			fmt.Printf("pkg: %s\n", pkg)
+		}
+		for _, unit := range units {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "name\told %s\tnew %s\tdelta\n", unitName(unit), unitName(unit))
+			rows := 0
+			for _, key := range before.keys {
+				if key.pkg != pkg || key.unit != unit {
+					continue
+				}
+				oldValues, newValues := before.values[key], after.values[key]
+				if len(newValues) == 0 {
+					fmt.Fprintf(w, "%s\t%s\t\t\t\n", key.name, formatSummary(oldValues, unit))
+					rows++
+					continue
+				}
+				p := mannWhitneyP(oldValues, newValues)
+				delta := "~"
+				if p < benchAlpha && mean(oldValues) != 0 {
+					delta = fmt.Sprintf("%+.2f%%", (mean(newValues)-mean(oldValues))/mean(oldValues)*100)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t(p=%.3f n=%d+%d)\n", key.name, formatSummary(oldValues, unit),
+					formatSummary(newValues, unit), delta, p, len(oldValues), len(newValues))
+				rows++
+			}
+			if rows > 0 {
+				w.Flush()
+				fmt.Println()
+			}
+		}
+	}
+}
+
+// unitName returns the column name benchstat uses for the unit.
+func unitName(unit string) string {
+	switch unit {
+	case "ns/op":
+		return "time/op"
+	case "B/op":
+		return "alloc/op"
+	}
+	return unit
+}
+
+// formatSummary formats the mean of the values measured in unit followed by their largest deviation
+// from it in percent.
+func formatSummary(values []float64, unit string) string {
+	m := mean(values)
+	dev := 0.0
+	for _, v := range values {
+		dev = math.Max(dev, math.Abs(v-m))
+	}
+	if m == 0 {
+		return formatValue(m, unit)
+	}
+	return fmt.Sprintf("%s ± %.0f%%", formatValue(m, unit), dev/m*100)
+}
+
+// formatValue formats v measured in unit with three significant digits, scaling times and sizes.
+func formatValue(v float64, unit string) string {
+	var scales []string
+	var factor float64
+	switch unit {
+	case "ns/op":
+		scales, factor = []string{"ns", "µs", "ms", "s"}, 1000
+	case "B/op":
+		scales, factor = []string{"B", "kB", "MB", "GB"}, 1000
+	default:
+		scales, factor = []string{""}, 1
+	}
+	i := 0
+	for ; i < len(scales)-1 && v >= factor; i++ {
+		v /= factor
+	}
+	var digits int
+	switch {
+	case v >= 100 || v == math.Trunc(v):
+		digits = 0
+	case v >= 10:
+		digits = 1
+	default:
+		digits = 2
+	}
+	return strconv.FormatFloat(v, 'f', digits, 64) + scales[i]
+}
+
+// mean returns the arithmetic mean of values.
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// mannWhitneyP returns the two sided p-value of the Mann-Whitney U test of the samples a and b, i.e. the
+// probability of measuring samples at least this different if both came from the same distribution.
+// It uses the normal approximation corrected for ties and continuity, which is close enough for the
+// sample sizes of benchmark runs.
+func mannWhitneyP(a, b []float64) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	n := n1 + n2
+	type sample struct {
+		v     float64
+		fromA bool
+	}
+	all := make([]sample, 0, len(a)+len(b))
+	for _, v := range a {
+		all = append(all, sample{v, true})
+	}
+	for _, v := range b {
+		all = append(all, sample{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].v < all[j].v
+	})
+	// tied samples share the mean of their ranks
+	var rankSumA, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromA {
+				rankSumA += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+	u := rankSumA - n1*(n1+1)/2
+	variance := n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	z := (math.Abs(u-n1*n2/2) - 0.5) / math.Sqrt(variance)
+	if z < 0 {
+		return 1
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMannWhitneyP(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		{name: "disjoint", a: []float64{1, 2, 3, 4, 5}, b: []float64{6, 7, 8, 9, 10}, want: 0.012186},
+		{name: "disjoint swapped", a: []float64{6, 7, 8, 9, 10}, b: []float64{1, 2, 3, 4, 5}, want: 0.012186},
+		{name: "identical", a: []float64{1, 2, 3, 4, 5}, b: []float64{1, 2, 3, 4, 5}, want: 1},
+		{name: "interleaved", a: []float64{1, 3, 5, 7, 9}, b: []float64{2, 4, 6, 8, 10}, want: 0.676103},
+		{name: "ties", a: []float64{1, 1, 1, 2, 2}, b: []float64{2, 2, 3, 3, 3}, want: 0.026888},
+		{name: "all tied", a: []float64{4, 4, 4}, b: []float64{4, 4, 4}, want: 1},
+		{name: "ten runs", a: []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, b: []float64{20, 21, 22, 23, 24, 25, 26, 27, 28, 29}, want: 0.000183},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mannWhitneyP(tt.a, tt.b); math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("mannWhitneyP() = %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		v    float64
+		unit string
+		want string
+	}{
+		{v: 0, unit: "ns/op", want: "0ns"},
+		{v: 12.345, unit: "ns/op", want: "12.3ns"},
+		{v: 1234, unit: "ns/op", want: "1.23µs"},
+		{v: 2.5e9, unit: "ns/op", want: "2.50s"},
+		{v: 3.6e12, unit: "ns/op", want: "3600s"},
+		{v: 1500, unit: "B/op", want: "1.50kB"},
+		{v: 2e6, unit: "B/op", want: "2MB"},
+		{v: 3, unit: "allocs/op", want: "3"},
+		{v: 1234.4, unit: "allocs/op", want: "1234"},
+	}
+	for _, tt := range tests {
+		if got := formatValue(tt.v, tt.unit); got != tt.want {
+			t.Errorf("formatValue(%v, %s) = %s, want %s", tt.v, tt.unit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// key identifies the tagged interface across rewrites, which may shift its row.
+func (t *taggedInterface) key() string {
+	return t.filepath + ":" + t.name
+}
+
+// bisector finds the tagged interfaces whose rewrite breaks the build by building the project with
+// subsets of them rewritten. Every trial build is made through an overlay, so the source files are
+// left untouched.
+type bisector struct {
+	ctx        context.Context
+	cfg        *config
+	rootFolder string
+	// outcomes caches the outcome of each trial build keyed by the sorted keys of the rewritten interfaces
+	outcomes map[string]bool
+}
+
+// bisect finds the minimal sets of tagged interfaces in the project whose rewrite makes the build fail
+// and prints them. It returns the keys of every interface in the sets found. A set is minimal in the
+// sense that the build succeeds if any one of its interfaces is left as an interface.
+func bisect(ctx context.Context, cfg *config, rootFolder string) (map[string]bool, error) {
+	b := &bisector{ctx: ctx, cfg: cfg, rootFolder: rootFolder, outcomes: make(map[string]bool)}
+	var all []*taggedInterface
+	var processedInterfaces []taggedInterface
+	for {
+		taggedIf := nextInterfaceToProcess(nil, cfg, rootFolder, &processedInterfaces, ifdefTag)
+		if taggedIf == nil {
+			break
+		}
+		all = append(all, taggedIf)
+	}
+	fmt.Fprintf(os.Stderr, "Bisecting %d tagged interfaces\n", len(all))
+	ok, err := b.builds(nil, all)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("the project does not build without rewriting any interface")
+	}
+
+	offending := make(map[string]bool)
+	remaining := all
+	for {
+		ok, err := b.builds(remaining, all)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		failing, err := ddmin(remaining, func(rewritten []*taggedInterface) (bool, error) {
+			return b.builds(rewritten, all)
+		})
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "The build fails when rewriting:\n")
+		for _, taggedIf := range failing {
+			fmt.Fprintf(os.Stderr, "\t%s:%d: %s\n", taggedIf.filepath, taggedIf.row-1, taggedIf.name)
+			offending[taggedIf.key()] = true
+		}
+		var rest []*taggedInterface
+		for _, taggedIf := range remaining {
+			if !offending[taggedIf.key()] {
+				rest = append(rest, taggedIf)
+			}
+		}
+		remaining = rest
+	}
+	if len(offending) == 0 {
+		fmt.Fprintf(os.Stderr, "The build succeeds with every tagged interface rewritten\n")
+	}
+	return offending, nil
+}
+
+// ddmin returns a 1-minimal subset of the interfaces in failing whose rewrite still makes the build
+// fail, following Zeller's delta debugging algorithm. Builds reports whether the project builds with
+// the interfaces given rewritten, and must report false for failing.
+func ddmin(failing []*taggedInterface, builds func([]*taggedInterface) (bool, error)) ([]*taggedInterface, error) {
+	n := 2
+	for len(failing) > 1 {
+		chunks := split(failing, n)
+		reduced := false
+		for _, chunk := range chunks {
+			ok, err := builds(chunk)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				failing, n, reduced = chunk, 2, true
+				break
+			}
+		}
+		if !reduced && n > 2 {
+			for i := range chunks {
+				var complement []*taggedInterface
+				for j, chunk := range chunks {
+					if j != i {
+						complement = append(complement, chunk...)
+					}
+				}
+				ok, err := builds(complement)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					failing, n, reduced = complement, n-1, true
+					break
+				}
+			}
+		}
+		if reduced {
+			continue
+		}
+		if n >= len(failing) {
+			break
+		}
+		n *= 2
+		if n > len(failing) {
+			n = len(failing)
+		}
+	}
+	return failing, nil
+}
+
+// split splits ifs into n chunks of nearly equal size.
+func split(ifs []*taggedInterface, n int) [][]*taggedInterface {
+	var chunks [][]*taggedInterface
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + (len(ifs)-start)/(n-i)
+		chunks = append(chunks, ifs[start:end])
+		start = end
+	}
+	return chunks
+}
+
+// builds reports whether the project builds with the interfaces in rewritten rewritten and the rest of
+// the interfaces in all left as interfaces.
+func (b *bisector) builds(rewritten, all []*taggedInterface) (bool, error) {
+	keys := make([]string, len(rewritten))
+	for i, taggedIf := range rewritten {
+		keys[i] = taggedIf.key()
+	}
+	sort.Strings(keys)
+	cacheKey := strings.Join(keys, "\n")
+	if ok, found := b.outcomes[cacheKey]; found {
+		return ok, nil
+	}
+	excluded := make(map[string]bool)
+	for _, taggedIf := range all {
+		excluded[taggedIf.key()] = true
+	}
+	for _, key := range keys {
+		delete(excluded, key)
+	}
+	ov, err := newOverlay()
+	if err != nil {
+		return false, fmt.Errorf("could not create overlay: %s", err)
+	}
+	defer ov.remove()
+	// a rewrite breaking the code makes loading the project for the next rewrite fail, which counts
+	// as a failing build
+	r := &rewriter{ctx: b.ctx, cfg: b.cfg, rootFolder: b.rootFolder, ov: ov, excluded: excluded}
+	if err = r.rewriteAll(); err == nil {
+		var overlayFp string
+		if overlayFp, err = ov.writeJSON(); err != nil {
+			return false, fmt.Errorf("could not write overlay: %s", err)
+		}
+		args := append([]string{"build", "-overlay=" + overlayFp}, loadPatterns(b.ctx, b.cfg, b.rootFolder)...)
+		cmd := exec.CommandContext(b.ctx, b.cfg.goBinary(), args...)
+		cmd.Dir = b.rootFolder
+		cmd.Env = b.cfg.env()
+		err = cmd.Run()
+	}
+	if b.ctx.Err() != nil {
+		return false, errors.New("Interrupted")
+	}
+	ok := err == nil
+	b.outcomes[cacheKey] = ok
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = filepath.Base(key)
+	}
+	if ok {
+		fmt.Fprintf(os.Stderr, "\tbuilds rewriting {%s}\n", strings.Join(names, ", "))
+	} else {
+		fmt.Fprintf(os.Stderr, "\tfails rewriting {%s}\n", strings.Join(names, ", "))
+	}
+	return ok, nil
+}
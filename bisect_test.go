@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// taggedInterfaces returns a tagged interface for each letter of names.
+func taggedInterfaces(names string) []*taggedInterface {
+	var ifs []*taggedInterface
+	for _, name := range names {
+		ifs = append(ifs, &taggedInterface{filepath: "lib.go", name: string(name)})
+	}
+	return ifs
+}
+
+// interfaceNames returns the names of ifs joined.
+func interfaceNames(ifs []*taggedInterface) string {
+	var sb strings.Builder
+	for _, taggedIf := range ifs {
+		sb.WriteString(taggedIf.name)
+	}
+	return sb.String()
+}
+
+func TestDdmin(t *testing.T) {
+	tests := []struct {
+		name string
+		all  string
+		// culprits holds sets of interfaces, the build fails if all the interfaces of any set are rewritten
+		culprits []string
+		want     string
+	}{
+		{name: "single interface", all: "A", culprits: []string{"A"}, want: "A"},
+		{name: "single culprit", all: "ABCDEFGH", culprits: []string{"E"}, want: "E"},
+		{name: "last of odd count", all: "ABCDEFG", culprits: []string{"G"}, want: "G"},
+		{name: "pair split across halves", all: "ABCDEFGH", culprits: []string{"CF"}, want: "CF"},
+		{name: "pair in one chunk", all: "ABCDEFGH", culprits: []string{"AB"}, want: "AB"},
+		{name: "triple", all: "ABCDEFGH", culprits: []string{"BDG"}, want: "BDG"},
+		{name: "every interface", all: "ABC", culprits: []string{"ABC"}, want: "ABC"},
+		{name: "either of two", all: "ABCDEFGH", culprits: []string{"A", "H"}, want: "A"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builds := func(rewritten []*taggedInterface) (bool, error) {
+				names := interfaceNames(rewritten)
+				for _, culprit := range tt.culprits {
+					found := true
+					for _, name := range culprit {
+						found = found && strings.ContainsRune(names, name)
+					}
+					if found {
+						return false, nil
+					}
+				}
+				return true, nil
+			}
+			got, err := ddmin(taggedInterfaces(tt.all), builds)
+			if err != nil {
+				t.Fatalf("ddmin() error = %v", err)
+			}
+			if interfaceNames(got) != tt.want {
+				t.Errorf("ddmin() = %s, want %s", interfaceNames(got), tt.want)
+			}
+			// the result is 1-minimal
+			for i := range got {
+				rest := append(append([]*taggedInterface(nil), got[:i]...), got[i+1:]...)
+				if ok, _ := builds(rest); !ok && len(rest) > 0 {
+					t.Errorf("ddmin() = %s still fails without %s", interfaceNames(got), got[i].name)
+				}
+			}
+		})
+	}
+}
+
+func TestDdminError(t *testing.T) {
+	errBuild := errors.New("interrupted")
+	_, err := ddmin(taggedInterfaces("ABCD"), func([]*taggedInterface) (bool, error) {
+		return false, errBuild
+	})
+	if err != errBuild {
+		t.Errorf("ddmin() error = %v, want %v", err, errBuild)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		all  string
+		n    int
+		want []string
+	}{
+		{all: "ABCD", n: 2, want: []string{"AB", "CD"}},
+		{all: "ABCDE", n: 2, want: []string{"AB", "CDE"}},
+		{all: "ABCDEFG", n: 3, want: []string{"AB", "CD", "EFG"}},
+		{all: "ABC", n: 3, want: []string{"A", "B", "C"}},
+	}
+	for _, tt := range tests {
+		chunks := split(taggedInterfaces(tt.all), tt.n)
+		var got []string
+		for _, chunk := range chunks {
+			got = append(got, interfaceNames(chunk))
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("split(%s, %d) = %v, want %v", tt.all, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// config is the configuration read from the hidden file .noifgo in the project's root folder. An
+// empty or missing file configures the defaults.
+type config struct {
+	// Include holds slash separated glob patterns, relative to the root folder, of the files and folders
+	// searched for tagged interfaces. If empty every file is searched.
+	Include []string `json:"include"`
+	// Exclude holds glob patterns of the files and folders not searched for tagged interfaces, which
+	// take precedence over Include.
+	Exclude []string `json:"exclude"`
+	// ImplPrefix is prefixed to the name of each replacing implementation, which also exports it.
+	ImplPrefix string `json:"implPrefix"`
+	// Mocks holds import path patterns, e.g. example.com/foo/mocks/..., of packages whose types are not
+	// taken as implementations of an interface.
+	Mocks []string `json:"mocks"`
+	// Default is what an untagged reference is replaced by, "p", "v" or "auto".
+	Default string `json:"default"`
+	// Go is the go binary to invoke, either a name looked up in PATH or a filepath.
+	Go string `json:"go"`
+	// goroot is the GOROOT of the go binary if it is not the go binary found in PATH
+	goroot string
+	// implPrefix matches a name starting with ImplPrefix, capturing the rest of the name
+	implPrefix *regexp.Regexp
+}
+
+// readConfig reads the configuration of the project in rootFolder. Options not set in the file are
+// set to their defaults. An error is returned if the file is not valid JSON or an option is invalid.
+func readConfig(rootFolder string) (*config, error) {
+	c := &config{}
+	b, err := ioutil.ReadFile(filepath.Join(rootFolder, hiddenFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", hiddenFilename, err)
+		}
+	}
+	if c.ImplPrefix == "" {
+		c.ImplPrefix = "NoIFGo"
+	}
+	if !token.IsIdentifier(c.ImplPrefix) || !token.IsExported(c.ImplPrefix) {
+		return nil, fmt.Errorf("implPrefix %q must be an identifier starting with an upper case letter", c.ImplPrefix)
+	}
+	c.implPrefix = regexp.MustCompile(`\b` + regexp.QuoteMeta(c.ImplPrefix) + `(\w+)`)
+	if c.Default == "" {
+		c.Default = "auto"
+	}
+	if c.Default != "p" && c.Default != "v" && c.Default != "auto" {
+		return nil, errors.New("default must either be 'p', 'v' or 'auto'")
+	}
+	for _, pattern := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("malformed glob pattern %q: %s", pattern, err)
+		}
+	}
+	if c.Go == "" {
+		c.Go = "go"
+	}
+	if c.Go != "go" {
+		// go/packages invokes the go binary found in PATH, so the GOROOT of the configured binary is
+		// put first in PATH for it
+		out, err := exec.Command(c.Go, "env", "GOROOT").Output()
+		if err != nil {
+			return nil, fmt.Errorf("could not run go binary %s: %s", c.Go, err)
+		}
+		c.goroot = strings.TrimSpace(string(out))
+	}
+	return c, nil
+}
+
+// env returns the environment to invoke the go binary in, or nil for the environment of this process.
+func (c *config) env() []string {
+	if c == nil || c.goroot == "" {
+		return nil
+	}
+	return append(os.Environ(), "PATH="+filepath.Join(c.goroot, "bin")+string(filepath.ListSeparator)+os.Getenv("PATH"))
+}
+
+// goBinary returns the go binary to invoke.
+func (c *config) goBinary() string {
+	if c == nil {
+		return "go"
+	}
+	return c.Go
+}
+
+// searched reports whether the file given by fp in rootFolder is searched for tagged interfaces.
+func (c *config) searched(rootFolder, fp string) bool {
+	if c == nil {
+		return true
+	}
+	if c.excluded(rootFolder, fp) {
+		return false
+	}
+	if len(c.Include) == 0 {
+		return true
+	}
+	rel, err := filepath.Rel(rootFolder, fp)
+	return err != nil || matchGlobs(c.Include, filepath.ToSlash(rel))
+}
+
+// excluded reports whether the file or folder given by fp in rootFolder is excluded from the search
+// for tagged interfaces.
+func (c *config) excluded(rootFolder, fp string) bool {
+	if c == nil {
+		return false
+	}
+	rel, err := filepath.Rel(rootFolder, fp)
+	if err != nil {
+		return false
+	}
+	return matchGlobs(c.Exclude, filepath.ToSlash(rel))
+}
+
+// matchGlobs reports whether any of the glob patterns matches the slash separated relative path rel or
+// one of its parent folders.
+func matchGlobs(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripImplPrefix returns s with the implementation prefix removed from the start of every word, so that
+// the names of implementations read the same before and after the rewrite.
+func (c *config) stripImplPrefix(s string) string {
+	return c.implPrefix.ReplaceAllString(s, "$1")
+}
+
+// prefixedNames returns the names starting with the implementation prefix found in s, e.g. NoIFGosq.
+func (c *config) prefixedNames(s string) []string {
+	return c.implPrefix.FindAllString(s, -1)
+}
+
+// isMock reports whether the package given by pkgPath is configured to hold mocks.
+func (c *config) isMock(pkgPath string) bool {
+	if c == nil {
+		return false
+	}
+	for _, pattern := range c.Mocks {
+		if pattern == pkgPath {
+			return true
+		}
+		if prefix := strings.TrimSuffix(pattern, "/..."); prefix != pattern && (pkgPath == prefix || strings.HasPrefix(pkgPath, prefix+"/")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const helpDiff = `Usage:
+
+	noifgo diff [-patch file]
+
+Diff rewrites every tagged interface of the project the same way a build does, but into a scratch
+copy, and prints a unified diff of each rewritten source file without building the project. The
+source files are left untouched.
+
+The flags are:
+
+	-patch file
+		also write the diff to file as a patch which "git apply" applies to the
+		source files.
+
+`
+
+// diffContext is the number of unchanged lines surrounding each hunk of a unified diff.
+const diffContext = 3
+
+// lineEdit is a line of a file that is kept, deleted or inserted by a diff, as marked by op being
+// ' ', '-' or '+'.
+type lineEdit struct {
+	op   byte
+	line string
+}
+
+// diff implements the "noifgo diff" command.
+func diff(ctx context.Context, cfg *config, rootFolder string, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Printf(helpDiff)
+	}
+	patchFp := fs.String("patch", "", "File to write the diff to as a patch.")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	ov, err := newOverlay()
+	if err != nil {
+		return fmt.Errorf("could not create overlay: %s", err)
+	}
+	defer ov.remove()
+	r := &rewriter{ctx: ctx, cfg: cfg, rootFolder: rootFolder, ov: ov}
+	if err = r.rewriteAll(); err != nil {
+		return err
+	}
+
+	// paths in the patch are relative to the top level folder of the git repository, if any, since
+	// that is what git apply expects
+	base := rootFolder
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "--show-toplevel")
+	cmd.Dir = rootFolder
+	if out, err := cmd.Output(); err == nil {
+		base = strings.TrimSpace(string(out))
+	}
+	fps := make([]string, 0, len(ov.replace))
+	for fp := range ov.replace {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+	var patch bytes.Buffer
+	for _, fp := range fps {
+		before, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+		after, err := ov.readFile(fp)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, fp)
+		if err != nil {
+			rel = fp
+		}
+		patch.WriteString(unifiedDiff(filepath.ToSlash(rel), before, after))
+	}
+	if patch.Len() == 0 {
+		fmt.Fprintf(os.Stderr, "No source files would be rewritten\n")
+		return nil
+	}
+	fmt.Printf("%s", patch.Bytes())
+	if *patchFp != "" {
+		if err = ioutil.WriteFile(*patchFp, patch.Bytes(), os.FileMode(0666)); err != nil {
+			return fmt.Errorf("could not write patch %s: %s", *patchFp, err)
+		}
+	}
+	return nil
+}
+
+// unifiedDiff returns the unified diff, in the format of git diff, turning the content before of the
+// file given by the relative path rel into after. If the contents are equal an empty string is returned.
+func unifiedDiff(rel string, before, after []byte) string {
+	if bytes.Equal(before, after) {
+		return ""
+	}
+	edits := diffLines(splitLines(before), splitLines(after))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "diff --git a/%s b/%s\n--- a/%s\n+++ b/%s\n", rel, rel, rel, rel)
+	// aLine and bLine are the number of lines of before and after preceding edits[i]
+	aLine, bLine := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			aLine++
+			bLine++
+			i++
+			continue
+		}
+		// a hunk starts diffContext lines before the change and ends once more than twice as many
+		// unchanged lines follow a change
+		start := i
+		for start > 0 && i-start < diffContext && edits[start-1].op == ' ' {
+			start--
+		}
+		end := i
+		for unchanged := 0; end < len(edits) && unchanged <= 2*diffContext; end++ {
+			if edits[end].op == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > i && edits[end-1].op == ' ' {
+			end--
+		}
+		for n := 0; n < diffContext && end < len(edits) && edits[end].op == ' '; n++ {
+			end++
+		}
+		aStart, bStart := aLine-(i-start), bLine-(i-start)
+		var aLen, bLen int
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				aLen++
+			}
+			if e.op != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+		for _, e := range edits[start:end] {
+			sb.WriteByte(e.op)
+			sb.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		aLine, bLine = aStart+aLen, bStart+bLen
+		i = end
+	}
+	return sb.String()
+}
+
+// hunkRange formats the range of a hunk starting after the line given by start and spanning n lines.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// splitLines splits b into lines including their line feeds. The last line lacks a line feed if b
+// does not end with one.
+func splitLines(b []byte) []string {
+	lines := strings.SplitAfter(string(b), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit script turning the lines a into the lines b, found by Myers'
+// algorithm. The lines the two have in common at their beginning and end are kept outright.
+func diffLines(a, b []string) []lineEdit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var edits []lineEdit
+	for _, line := range a[:prefix] {
+		edits = append(edits, lineEdit{op: ' ', line: line})
+	}
+	edits = append(edits, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		edits = append(edits, lineEdit{op: ' ', line: line})
+	}
+	return edits
+}
+
+// myers returns the shortest edit script turning the lines a into the lines b.
+func myers(a, b []string) []lineEdit {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	// v holds the furthest x reached on each diagonal k, indexed by k+offset, and trace a copy of v
+	// for each edit distance d
+	v := make([]int, 2*max+3)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+				x = v[k+1+offset]
+			} else {
+				x = v[k-1+offset] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+offset] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+		if done {
+			break
+		}
+	}
+
+	// backtracks from the end through the trace collecting the edits in reverse
+	var edits []lineEdit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+offset]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, lineEdit{op: ' ', line: a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, lineEdit{op: '+', line: b[prevY]})
+			} else {
+				edits = append(edits, lineEdit{op: '-', line: a[prevX]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
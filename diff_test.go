@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		// edits is the expected edit script, one op per line
+		edits string
+	}{
+		{name: "equal", a: "a\nb\n", b: "a\nb\n", edits: "  "},
+		{name: "both empty", a: "", b: "", edits: ""},
+		{name: "from empty", a: "", b: "a\nb\n", edits: "++"},
+		{name: "to empty", a: "a\nb\n", b: "", edits: "--"},
+		{name: "replace", a: "a\nb\nc\n", b: "a\nx\nc\n", edits: " -+ "},
+		{name: "insert", a: "a\nc\n", b: "a\nb\nc\n", edits: " + "},
+		{name: "delete", a: "a\nb\nc\n", b: "a\nc\n", edits: " - "},
+		{name: "multi-line replace", a: "a\nb\nc\nd\n", b: "a\nx\ny\nz\nd\n", edits: " --+++ "},
+		{name: "moved line", a: "a\nb\nc\n", b: "b\nc\na\n", edits: "-  +"},
+		{name: "no shared lines", a: "a\nb\n", b: "c\nd\n", edits: "--++"},
+		{name: "missing final newline", a: "a\nb", b: "a\nb\n", edits: " -+"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := splitLines([]byte(tt.a)), splitLines([]byte(tt.b))
+			edits := diffLines(a, b)
+			var ops strings.Builder
+			var gotA, gotB []string
+			for _, e := range edits {
+				ops.WriteByte(e.op)
+				if e.op != '+' {
+					gotA = append(gotA, e.line)
+				}
+				if e.op != '-' {
+					gotB = append(gotB, e.line)
+				}
+			}
+			if ops.String() != tt.edits {
+				t.Errorf("diffLines(%q, %q) ops = %q, want %q", tt.a, tt.b, ops.String(), tt.edits)
+			}
+			if strings.Join(gotA, "") != tt.a || strings.Join(gotB, "") != tt.b {
+				t.Errorf("diffLines(%q, %q) turns %q into %q", tt.a, tt.b, strings.Join(gotA, ""), strings.Join(gotB, ""))
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	numbered := func(from, to int, replace map[int]string) string {
+		var sb strings.Builder
+		for i := from; i <= to; i++ {
+			if s, ok := replace[i]; ok {
+				sb.WriteString(s)
+				continue
+			}
+			sb.WriteString(strings.Repeat("x", i%3+1) + string(rune('a'+i%26)) + "\n")
+		}
+		return sb.String()
+	}
+	tests := []struct {
+		name          string
+		before, after string
+		want          string
+	}{
+		{
+			name:   "equal",
+			before: "a\nb\n",
+			after:  "a\nb\n",
+			want:   "",
+		},
+		{
+			name:   "replace in the middle",
+			before: "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			after:  "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			want: "diff --git a/f.go b/f.go\n--- a/f.go\n+++ b/f.go\n" +
+				"@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name:   "insert at the start",
+			before: "a\nb\n",
+			after:  "x\na\nb\n",
+			want: "diff --git a/f.go b/f.go\n--- a/f.go\n+++ b/f.go\n" +
+				"@@ -1,2 +1,3 @@\n+x\n a\n b\n",
+		},
+		{
+			name:   "delete at the end",
+			before: "a\nb\nc\n",
+			after:  "a\nb\n",
+			want: "diff --git a/f.go b/f.go\n--- a/f.go\n+++ b/f.go\n" +
+				"@@ -1,3 +1,2 @@\n a\n b\n-c\n",
+		},
+		{
+			name:   "to empty",
+			before: "a\n",
+			after:  "",
+			want: "diff --git a/f.go b/f.go\n--- a/f.go\n+++ b/f.go\n" +
+				"@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name:   "missing final newline",
+			before: "a\nb",
+			after:  "a\nc",
+			want: "diff --git a/f.go b/f.go\n--- a/f.go\n+++ b/f.go\n" +
+				"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+		{
+			name:   "close changes share a hunk",
+			before: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			after:  "1\ntwo\n3\n4\n5\n6\n7\n8\nnine\n10\n",
+			want: "diff --git a/f.go b/f.go\n--- a/f.go\n+++ b/f.go\n" +
+				"@@ -1,10 +1,10 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n 8\n-9\n+nine\n 10\n",
+		},
+		{
+			name:   "distant changes get a hunk each",
+			before: numbered(1, 20, nil),
+			after:  numbered(1, 20, map[int]string{2: "two\n", 18: "eighteen\n"}),
+			want: "diff --git a/f.go b/f.go\n--- a/f.go\n+++ b/f.go\n" +
+				"@@ -1,5 +1,5 @@\n" + " " + numbered(1, 1, nil) + "-" + numbered(2, 2, nil) + "+two\n" +
+				" " + numbered(3, 3, nil) + " " + numbered(4, 4, nil) + " " + numbered(5, 5, nil) +
+				"@@ -15,6 +15,6 @@\n" + " " + numbered(15, 15, nil) + " " + numbered(16, 16, nil) + " " + numbered(17, 17, nil) +
+				"-" + numbered(18, 18, nil) + "+eighteen\n" + " " + numbered(19, 19, nil) + " " + numbered(20, 20, nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("f.go", []byte(tt.before), []byte(tt.after)); got != tt.want {
+				t.Errorf("unifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
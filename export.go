@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const helpExport = `Usage:
+
+	noifgo export -o dir
+
+Export rewrites every tagged interface of the project the same way a build does and writes the
+rewritten project to the folder dir, which must not exist or be empty. The whole module, or
+workspace, the project belongs to is written including its go.mod or go.work file, so that dir
+can be built by any tool. The source files of the project are left untouched.
+
+`
+
+// export implements the "noifgo export" command.
+func export(ctx context.Context, cfg *config, rootFolder string, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Printf(helpExport)
+	}
+	outDir := fs.String("o", "", "Folder to write the rewritten project to.")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if *outDir == "" {
+		fs.Usage()
+		return errors.New("missing -o flag")
+	}
+	dst, err := filepath.Abs(*outDir)
+	if err != nil {
+		return err
+	}
+	if entries, err := ioutil.ReadDir(dst); err == nil && len(entries) > 0 {
+		return fmt.Errorf("folder %s is not empty", dst)
+	}
+	src, err := exportRoot(ctx, cfg, rootFolder)
+	if err != nil {
+		return err
+	}
+	if within(dst, src) {
+		return fmt.Errorf("folder %s is inside the exported folder %s", dst, src)
+	}
+
+	ov, err := newOverlay()
+	if err != nil {
+		return fmt.Errorf("could not create overlay: %s", err)
+	}
+	defer ov.remove()
+	r := &rewriter{ctx: ctx, cfg: cfg, rootFolder: rootFolder, ov: ov}
+	if err = r.rewriteAll(); err != nil {
+		return err
+	}
+	files, err := copyTree(ov, src, dst)
+	if err != nil {
+		return fmt.Errorf("could not export to %s: %s", dst, err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d files to %s, %d of them rewritten\n", files, dst, len(ov.replace))
+	return nil
+}
+
+// exportRoot returns the folder exported for the project in rootFolder. It is rootFolder if it holds a
+// go.mod or go.work file, otherwise the root folder of the workspace or module rootFolder belongs to.
+func exportRoot(ctx context.Context, cfg *config, rootFolder string) (string, error) {
+	for _, name := range []string{"go.work", "go.mod"} {
+		if _, err := os.Stat(filepath.Join(rootFolder, name)); err == nil {
+			return rootFolder, nil
+		}
+	}
+	cmd := exec.CommandContext(ctx, cfg.goBinary(), "env", "GOWORK", "GOMOD")
+	cmd.Dir = rootFolder
+	cmd.Env = cfg.env()
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("could not run go env: %s", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "off" || line == os.DevNull {
+			continue
+		}
+		return filepath.Dir(line), nil
+	}
+	return "", fmt.Errorf("could not find a go.mod or go.work file for %s", rootFolder)
+}
+
+// copyTree copies the files in the folder src and its sub folders to the folder dst, taking the content
+// of rewritten files from ov. Version control folders and the backup folder are left out. It returns
+// the number of files copied.
+func copyTree(ov *overlay, src, dst string) (int, error) {
+	files := 0
+	err := filepath.Walk(src, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fp)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			if fp != src && (info.Name() == ".git" || info.Name() == ".hg" || info.Name() == ".svn" || info.Name() == journalFoldername) {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(fp)
+			if err != nil {
+				return err
+			}
+			files++
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			b, err := ov.readFile(fp)
+			if err != nil {
+				return err
+			}
+			files++
+			return ioutil.WriteFile(target, b, info.Mode().Perm())
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,13 @@
+module github.com/strtob01/noifgo
+
+go 1.26.0
+
+require (
+	github.com/google/pprof v0.0.0-20260926063103-aaccee046517
+	golang.org/x/tools v0.50.0
+)
+
+require (
+	golang.org/x/mod v0.41.0 // indirect
+	golang.org/x/sync v0.23.0 // indirect
+)
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// guardedCall is a statement calling a method on a value of a tagged interface. In guarded mode the
+// statement is rewritten to call the method directly on the chosen implementation whenever the
+// interface value holds it, e.g.
+//
+//	if noifgoImpl, noifgoOk := x.(*pkg.NoIFGoImpl); noifgoOk {
+//		noifgoImpl.M()
+//	} else {
+//		x.M()
+//	}
+type guardedCall struct {
+	filepath string
+	stmt     ast.Stmt
+	call     *ast.CallExpr
+	sel      *ast.SelectorExpr
+}
+
+// guardedCalls returns every statement in the project, test files included, calling a method on a
+// value of the interface given by tn, sorted by filepath and position. Only statements that can be
+// guarded without changing the program's semantics are returned: call statements, assignments and
+// returns of a single call whose receiver is a variable or a chain of field selections, so that
+// evaluating it twice has no side effects.
+func (p *program) guardedCalls(tn *types.TypeName) []guardedCall {
+	var calls []guardedCall
+	p.eachFile(func(pkg *packages.Package, f *ast.File, fp string) {
+		var fileCalls []guardedCall
+		ast.Inspect(f, func(n ast.Node) bool {
+			var list []ast.Stmt
+			switch n := n.(type) {
+			case *ast.BlockStmt:
+				list = n.List
+			case *ast.CaseClause:
+				list = n.Body
+			case *ast.CommClause:
+				list = n.Body
+			default:
+				return true
+			}
+			for _, stmt := range list {
+				call := guardableCall(stmt)
+				if call == nil {
+					continue
+				}
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok || !sideEffectFree(sel.X) {
+					continue
+				}
+				selection, ok := pkg.TypesInfo.Selections[sel]
+				if !ok || selection.Kind() != types.MethodVal {
+					continue
+				}
+				// the interface type of a test variant is a distinct type
+				if named, ok := selection.Recv().(*types.Named); !ok || !p.sameObject(named.Obj(), tn) {
+					continue
+				}
+				fileCalls = append(fileCalls, guardedCall{filepath: fp, stmt: stmt, call: call, sel: sel})
+			}
+			return true
+		})
+		calls = append(calls, outermostCalls(fileCalls)...)
+	})
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].filepath != calls[j].filepath {
+			return calls[i].filepath < calls[j].filepath
+		}
+		return calls[i].stmt.Pos() < calls[j].stmt.Pos()
+	})
+	return calls
+}
+
+// guardableCall returns the call made by stmt if stmt is a call statement, an assignment of a single
+// call or a return of a single call. Otherwise nil is returned.
+func guardableCall(stmt ast.Stmt) *ast.CallExpr {
+	var expr ast.Expr
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		expr = stmt.X
+	case *ast.AssignStmt:
+		// declarations would be scoped to the branches of the guard
+		if stmt.Tok == token.DEFINE || len(stmt.Rhs) != 1 {
+			return nil
+		}
+		expr = stmt.Rhs[0]
+	case *ast.ReturnStmt:
+		if len(stmt.Results) != 1 {
+			return nil
+		}
+		expr = stmt.Results[0]
+	default:
+		return nil
+	}
+	call, _ := expr.(*ast.CallExpr)
+	return call
+}
+
+// sideEffectFree reports whether expr is an identifier or a chain of selections on an identifier.
+func sideEffectFree(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return true
+	case *ast.SelectorExpr:
+		return sideEffectFree(expr.X)
+	}
+	return false
+}
+
+// outermostCalls drops the calls whose statements are nested inside the statement of another call,
+// e.g. in the body of a function literal passed as an argument, since both can not be rewritten.
+func outermostCalls(calls []guardedCall) []guardedCall {
+	var outermost []guardedCall
+	for _, c := range calls {
+		nested := false
+		for _, o := range calls {
+			if o.stmt != c.stmt && o.stmt.Pos() <= c.stmt.Pos() && c.stmt.End() <= o.stmt.End() {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			outermost = append(outermost, c)
+		}
+	}
+	return outermost
+}
+
+// guardCalls rewrites the calls found in the file given by filepath into guarded calls asserting the
+// interface value to be of the type given by implType. The calls must belong to the same file and be
+// sorted by position.
+func (p *program) guardCalls(ov *overlay, filepath string, calls []guardedCall, implType string) error {
+	b, err := ov.readFile(filepath)
+	if err != nil {
+		return err
+	}
+	implVar := freshName(b, "noifgoImpl")
+	okVar := freshName(b, "noifgoOk")
+	// rewrites from the last call so that the offsets of the remaining calls stay valid
+	for i := len(calls) - 1; i >= 0; i-- {
+		c := calls[i]
+		start := p.fset.Position(c.stmt.Pos()).Offset
+		end := p.fset.Position(c.stmt.End()).Offset
+		lineStart := bytes.LastIndexByte(b[:start], '\n') + 1
+		indent := leadingSpace(b[lineStart:start])
+		original := string(b[start:end])
+		recvStart := p.fset.Position(c.sel.X.Pos()).Offset
+		recvEnd := p.fset.Position(c.sel.X.End()).Offset
+		recv := string(b[recvStart:recvEnd])
+		// from x.M(args) to noifgoImpl.M(args)
+		direct := string(b[start:recvStart]) + implVar + string(b[recvEnd:end])
+		var guarded bytes.Buffer
+		fmt.Fprintf(&guarded, "if %s, %s := %s.(%s); %s {\n", implVar, okVar, recv, implType, okVar)
+		fmt.Fprintf(&guarded, "%s\t%s\n", indent, direct)
+		if _, ok := c.stmt.(*ast.ReturnStmt); ok {
+			fmt.Fprintf(&guarded, "%s}\n%s%s", indent, indent, original)
+		} else {
+			fmt.Fprintf(&guarded, "%s} else {\n%s\t%s\n%s}", indent, indent, original, indent)
+		}
+		b = append(b[:start], append(guarded.Bytes(), b[end:]...)...)
+	}
+	return ov.writeFile(filepath, b)
+}
+
+// leadingSpace returns the whitespace at the beginning of b.
+func leadingSpace(b []byte) string {
+	return string(b[:len(b)-len(bytes.TrimLeft(b, " \t"))])
+}
+
+// freshName returns name, or name followed by a number, such that it does not occur in src.
+func freshName(src []byte, name string) string {
+	fresh := name
+	for i := 1; bytes.Contains(src, []byte(fresh)); i++ {
+		fresh = name + strconv.Itoa(i)
+	}
+	return fresh
+}
+
+// guardAs returns "p" if only a pointer to the implementation given by implTn implements the interface
+// iface and "v" otherwise, which is the type the guard asserts when the ifdef tag does not choose one.
+func guardAs(implTn *types.TypeName, iface *types.Interface) string {
+	if types.Implements(implTn.Type(), iface) {
+		return "v"
+	}
+	return "p"
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	journalFoldername = ".noifgo.backup"
+	journalFilename   = "journal"
+)
+
+// journalEntry records a single backed up source file.
+type journalEntry struct {
+	hash     string
+	backup   string
+	filepath string
+}
+
+// journal records every source file backed up before it is rewritten, so that an interrupted run can
+// be rolled back. The journal and the backups are stored in a hidden folder in the project's root folder.
+// Each entry is written to the journal before its source file is modified.
+type journal struct {
+	folder  string
+	entries []journalEntry
+}
+
+// journalExists reports whether a journal left behind by an earlier run exists in rootFolder.
+func journalExists(rootFolder string) bool {
+	_, err := os.Stat(filepath.Join(rootFolder, journalFoldername))
+	return err == nil
+}
+
+// newJournal creates an empty journal in rootFolder. It returns an error if a journal already exists.
+func newJournal(rootFolder string) (*journal, error) {
+	folder := filepath.Join(rootFolder, journalFoldername)
+	if err := os.Mkdir(folder, os.FileMode(0755)); err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("found journal of an interrupted run in %s, run \"noifgo restore\" first", folder)
+		}
+		return nil, err
+	}
+	j := &journal{folder: folder}
+	if err := ioutil.WriteFile(j.journalFilepath(), nil, os.FileMode(0644)); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// readJournal reads the journal found in rootFolder.
+func readJournal(rootFolder string) (*journal, error) {
+	j := &journal{folder: filepath.Join(rootFolder, journalFoldername)}
+	b, err := ioutil.ReadFile(j.journalFilepath())
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	row := 0
+	for scanner.Scan() {
+		row++
+		// <hash> <backup> <filepath>, the filepath may contain spaces and is therefore last
+		parts := strings.SplitN(scanner.Text(), " ", 3)
+		if len(parts) != 3 {
+			// the last entry may be incomplete if the run was interrupted while writing it, its source
+			// file was not modified yet since entries are written before any modification
+			fmt.Fprintf(os.Stderr, "skipping malformed journal entry on row %d\n", row)
+			continue
+		}
+		j.entries = append(j.entries, journalEntry{hash: parts[0], backup: parts[1], filepath: parts[2]})
+	}
+	return j, scanner.Err()
+}
+
+func (j *journal) journalFilepath() string {
+	return filepath.Join(j.folder, journalFilename)
+}
+
+// backup copies the file given by fp into the journal folder and records it in the journal.
+func (j *journal) backup(fp string) error {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return err
+	}
+	entry := journalEntry{
+		hash:     hashOf(b),
+		backup:   strconv.Itoa(len(j.entries)) + ".bak",
+		filepath: fp,
+	}
+	if err = writeFileSync(filepath.Join(j.folder, entry.backup), b); err != nil {
+		return fmt.Errorf("could not write backup of %s: %s", fp, err)
+	}
+	f, err := os.OpenFile(j.journalFilepath(), os.O_WRONLY|os.O_APPEND, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = fmt.Fprintf(f, "%s %s %s\n", entry.hash, entry.backup, entry.filepath); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	j.entries = append(j.entries, entry)
+	return f.Close()
+}
+
+// restore copies every backed up file back to its original location and removes the journal. Each
+// backup is verified against the hash recorded in the journal before it is restored. If any file
+// could not be restored the journal is kept so that the restore can be retried.
+func (j *journal) restore() (int, error) {
+	restored := 0
+	for _, entry := range j.entries {
+		b, err := ioutil.ReadFile(filepath.Join(j.folder, entry.backup))
+		if err != nil {
+			return restored, fmt.Errorf("could not read backup of %s: %s", entry.filepath, err)
+		}
+		if hashOf(b) != entry.hash {
+			return restored, fmt.Errorf("backup of %s does not match the hash recorded in the journal", entry.filepath)
+		}
+		if cur, err := ioutil.ReadFile(entry.filepath); err == nil && hashOf(cur) == entry.hash {
+			continue
+		}
+		if err = writeFileSync(entry.filepath, b); err != nil {
+			return restored, fmt.Errorf("could not restore %s: %s", entry.filepath, err)
+		}
+		restored++
+	}
+	return restored, os.RemoveAll(j.folder)
+}
+
+// hashOf returns the hex encoded SHA-256 hash of b.
+func hashOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileSync writes b to the file given by fp and flushes it to disk before returning.
+func writeFileSync(fp string, b []byte) error {
+	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
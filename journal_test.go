@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newBackedUpFile creates a journal in a new root folder holding a backup of a file with content,
+// rewrites the file with rewritten and returns the root folder and the filepath of the file.
+func newBackedUpFile(t *testing.T, content, rewritten string) (string, string) {
+	t.Helper()
+	root := t.TempDir()
+	fp := filepath.Join(root, "lib.go")
+	if err := ioutil.WriteFile(fp, []byte(content), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+	j, err := newJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.backup(fp); err != nil {
+		t.Fatalf("backup() error = %v", err)
+	}
+	if err = ioutil.WriteFile(fp, []byte(rewritten), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+	return root, fp
+}
+
+// readContent returns the content of the file given by fp.
+func readContent(t *testing.T, fp string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestJournalRestore(t *testing.T) {
+	root, fp := newBackedUpFile(t, "original", "rewritten")
+	if _, err := newJournal(root); err == nil {
+		t.Errorf("newJournal() succeeded while a journal exists")
+	}
+	j, err := readJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := j.restore()
+	if err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if restored != 1 {
+		t.Errorf("restore() = %d, want 1", restored)
+	}
+	if got := readContent(t, fp); got != "original" {
+		t.Errorf("restored content = %q, want %q", got, "original")
+	}
+	if journalExists(root) {
+		t.Errorf("journal still exists after restore")
+	}
+}
+
+func TestJournalRestoreHashMismatch(t *testing.T) {
+	root, fp := newBackedUpFile(t, "original", "rewritten")
+	j, err := readJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(j.folder, j.entries[0].backup), []byte("corrupted"), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = j.restore(); err == nil {
+		t.Fatalf("restore() of a corrupted backup succeeded")
+	}
+	if got := readContent(t, fp); got != "rewritten" {
+		t.Errorf("content = %q, want it left as %q", got, "rewritten")
+	}
+	if !journalExists(root) {
+		t.Errorf("journal was removed although the restore failed")
+	}
+}
+
+func TestJournalRestoreSkipsRestored(t *testing.T) {
+	root, fp := newBackedUpFile(t, "original", "original")
+	j, err := readJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := j.restore()
+	if err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if restored != 0 {
+		t.Errorf("restore() = %d, want 0", restored)
+	}
+	if got := readContent(t, fp); got != "original" {
+		t.Errorf("content = %q, want %q", got, "original")
+	}
+}
+
+func TestReadJournalTruncatedEntry(t *testing.T) {
+	root, fp := newBackedUpFile(t, "original", "rewritten")
+	f, err := os.OpenFile(filepath.Join(root, journalFoldername, journalFilename), os.O_WRONLY|os.O_APPEND, os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an entry cut off while being written, before its source file was modified
+	if _, err = f.WriteString(hashOf([]byte("other")) + " 1.b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	j, err := readJournal(root)
+	if err != nil {
+		t.Fatalf("readJournal() error = %v", err)
+	}
+	if len(j.entries) != 1 || j.entries[0].filepath != fp {
+		t.Fatalf("readJournal() entries = %v, want the entry of %s only", j.entries, fp)
+	}
+	if _, err = j.restore(); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if got := readContent(t, fp); got != "original" {
+		t.Errorf("restored content = %q, want %q", got, "original")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+)
+
+// addLineDirectives adds //line directives to every rewritten source file, so that the positions the
+// compiler records for the rewritten code, and in turn stack traces, profiles, debug info and compiler
+// errors, refer to the lines of the original source files.
+func (r *rewriter) addLineDirectives() error {
+	originals, err := r.originals()
+	if err != nil {
+		return err
+	}
+	for fp, original := range originals {
+		if filepath.Ext(fp) != ".go" {
+			continue
+		}
+		rewritten, err := r.ov.readFile(fp)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(original, rewritten) {
+			continue
+		}
+		if err = r.ov.writeFile(fp, lineDirectives(fp, original, rewritten)); err != nil {
+			return fmt.Errorf("could not add line directives to %s: %s", fp, err)
+		}
+	}
+	return nil
+}
+
+// originals returns the original content of every source file rewritten so far keyed by its filepath.
+func (r *rewriter) originals() (map[string][]byte, error) {
+	originals := make(map[string][]byte)
+	if r.ov != nil {
+		for fp := range r.ov.replace {
+			b, err := ioutil.ReadFile(fp)
+			if err != nil {
+				return nil, err
+			}
+			originals[fp] = b
+		}
+		return originals, nil
+	}
+	for _, entry := range r.jr.entries {
+		b, err := ioutil.ReadFile(filepath.Join(r.jr.folder, entry.backup))
+		if err != nil {
+			return nil, fmt.Errorf("could not read backup of %s: %s", entry.filepath, err)
+		}
+		originals[entry.filepath] = b
+	}
+	return originals, nil
+}
+
+// lineDirectives returns the rewritten content of the file given by fp with a //line directive added
+// wherever its lines stop following the lines of the original content in sequence, each rewritten line
+// mapped to an original line by mapRows.
+func lineDirectives(fp string, original, rewritten []byte) []byte {
+	origRows, _ := mapRows(splitLines(original), splitLines(rewritten))
+	inToken := multiLineTokenRows(rewritten)
+	var out bytes.Buffer
+	// row is the row the compiler assigns to the next rewritten line
+	row := 1
+	for i, line := range splitLines(rewritten) {
+		if origRows[i] != row && !inToken[i+1] {
+			out.WriteString("//line " + fp + ":" + strconv.Itoa(origRows[i]) + ":1\n")
+			row = origRows[i]
+		}
+		out.WriteString(line)
+		row++
+	}
+	return out.Bytes()
+}
+
+// mapRows returns the original row each of the rewritten lines stands for, indexed from 0, and whether
+// the rewrite changed or inserted it. The lines a change inserts in place of original lines stand for
+// the replaced rows in turn, the last replaced row standing for any further inserted lines, e.g. the
+// lines of a guard replacing a statement. A line inserted on its own stands for the original row it
+// precedes.
+func mapRows(original, rewritten []string) (origRows []int, changed []bool) {
+	origRow := 0
+	// deleted holds the original rows removed by the current change, and next the index in deleted of
+	// the row the next inserted line stands for
+	var deleted []int
+	next := 0
+	for _, e := range diffLines(original, rewritten) {
+		switch e.op {
+		case ' ':
+			origRow++
+			deleted, next = deleted[:0], 0
+			origRows = append(origRows, origRow)
+			changed = append(changed, false)
+		case '-':
+			origRow++
+			deleted = append(deleted, origRow)
+		case '+':
+			row := origRow + 1
+			if len(deleted) > 0 {
+				if next < len(deleted) {
+					row = deleted[next]
+				} else {
+					row = deleted[len(deleted)-1]
+				}
+				next++
+			} else if row > len(original) && len(original) > 0 {
+				row = len(original)
+			}
+			origRows = append(origRows, row)
+			changed = append(changed, true)
+		}
+	}
+	return origRows, changed
+}
+
+// multiLineTokenRows returns the rows of src starting inside a token spanning several rows, i.e. a raw
+// string literal or a general comment, where a //line directive can not be inserted.
+func multiLineTokenRows(src []byte) map[int]bool {
+	rows := make(map[int]bool)
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s scanner.Scanner
+	s.Init(file, src, nil, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok != token.STRING && tok != token.COMMENT {
+			continue
+		}
+		start := file.Line(pos)
+		end := file.Line(pos + token.Pos(len(lit)))
+		for row := start + 1; row <= end; row++ {
+			rows[row] = true
+		}
+	}
+	return rows
+}
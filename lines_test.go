@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestLineDirectives(t *testing.T) {
+	tests := []struct {
+		name                string
+		original, rewritten string
+		want                string
+	}{
+		{
+			name:      "unchanged",
+			original:  "a\nb\n",
+			rewritten: "a\nb\n",
+			want:      "a\nb\n",
+		},
+		{
+			name:      "replace",
+			original:  "a\nvar s Singer\nc\n",
+			rewritten: "a\nvar s *impl\nc\n",
+			want:      "a\nvar s *impl\nc\n",
+		},
+		{
+			name:      "pure insert",
+			original:  "a\nb\n",
+			rewritten: "a\nx\nb\n",
+			want:      "a\nx\n//line f.go:2:1\nb\n",
+		},
+		{
+			name:      "pure insert at the end",
+			original:  "a\nb\n",
+			rewritten: "a\nb\nx\n",
+			want:      "a\nb\n//line f.go:2:1\nx\n",
+		},
+		{
+			name:      "multi-line replace",
+			original:  "a\nx = s.Area()\nc\n",
+			rewritten: "a\nif c, ok := s.(*impl); ok {\n\tx = c.Area()\n} else {\n\tx = s.Area()\n}\nc\n",
+			want: "a\nif c, ok := s.(*impl); ok {\n//line f.go:2:1\n\tx = c.Area()\n//line f.go:2:1\n} else {\n" +
+				"//line f.go:2:1\n\tx = s.Area()\n//line f.go:2:1\n}\nc\n",
+		},
+		{
+			name:      "multi-line replace by more lines",
+			original:  "a\nb\nc\nd\n",
+			rewritten: "a\nB\nC\nE\nd\n",
+			want:      "a\nB\nC\n//line f.go:3:1\nE\nd\n",
+		},
+		{
+			name:      "multi-line replace by fewer lines",
+			original:  "a\nb\nc\nd\n",
+			rewritten: "a\nX\nd\n",
+			want:      "a\nX\n//line f.go:4:1\nd\n",
+		},
+		{
+			name:      "delete",
+			original:  "a\nb\nc\n",
+			rewritten: "a\nc\n",
+			want:      "a\n//line f.go:3:1\nc\n",
+		},
+		{
+			name:      "inside a raw string",
+			original:  "s := `x\ny`\n",
+			rewritten: "s := `x\nz\ny`\n",
+			want:      "s := `x\nz\ny`\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(lineDirectives("f.go", []byte(tt.original), []byte(tt.rewritten))); got != tt.want {
+				t.Errorf("lineDirectives() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,35 +3,86 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/imports"
-	"golang.org/x/tools/refactor/rename"
-	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// ifdefTag is the tag marking an interface definition to process.
+var ifdefTag = []byte("noifgo:ifdef")
+
+// goCmdWaitDelay is how long the go tool is given to exit once interrupted before it is killed, and how
+// long its output is waited for once it exited, e.g. while programs it ran still hold its stderr.
+const goCmdWaitDelay = 5 * time.Second
+
+// subcommands holds the subcommands of noifgo by name. Any other first argument is a go tool command run
+// on the rewritten project.
+var subcommands = map[string]func(ctx context.Context, cfg *config, rootFolder string, args []string) error{
+	"scan":    scan,
+	"bench":   bench,
+	"diff":    diff,
+	"export":  export,
+	"opt":     opt,
+	"size":    size,
+	"suggest": suggest,
+	"verify":  verify,
+}
+
 const (
-	debug      = false
-	implPrefix = "NoIFGo"
-	helpUsage  = `NoIFGo is a go tool wrapper that optimizes source code by replacing interfaces with their implementations and then using the go tool on the resulting code.
+	debug     = false
+	helpUsage = `NoIFGo is a go tool wrapper that optimizes source code by replacing interfaces with their implementations and then using the go tool on the resulting code.
 
 Usage:
 
-	noifgo	[args]	e.g. noifgo build -a -gcflags "-m -m"
+	noifgo	[flags]	[args]	e.g. noifgo build -a -gcflags "-m -m"
 
 The args are the same arguments the go tool expects, since this tool is a wrapper for it.
 For help, use "noifgo help".
 
+The commands are:
+
+	bench		compare the benchmarks of the original and the rewritten code
+	diff		print the rewrite of the source files as a unified diff without building
+	export		write the rewritten project to a folder without building it
+	opt		compare the inlining and escape analysis of the original and the rewritten code
+	restore		roll back the source files of an interrupted run
+	scan		list the interfaces with a single implementation and optionally tag them
+	size		compare the sizes, itabs and methods of the original and the rewritten binary
+	suggest		suggest interfaces to tag from a pprof CPU profile
+	verify		compare the results of the tests on the original and the rewritten code
+
+For help on a command, use "noifgo <command> -h".
+
+The flags are:
+
+	-overlay
+		write the rewritten source files to a temporary folder and pass them to
+		the go tool through its -overlay flag instead of modifying the source
+		files in place.
+	-bisect
+		build the project with subsets of the tagged interfaces rewritten and
+		report the minimal sets of interfaces whose rewrite makes the build fail.
+	-besteffort
+		with -bisect, go on to run the go tool with the interfaces reported left
+		as interfaces.
+
 `
-	helpNotFoundHiddenFile = `Could not find the hidden file .noifgo which should be placed in your projects root folder.
+	helpNotFoundHiddenFile = `Could not find the hidden file .noifgo which should be placed in your projects root folder,
+nor a go.work or go.mod file to use as the root folder instead.
 
 `
 )
@@ -52,6 +103,14 @@ type taggedInterface struct {
 	name     string
 	row      int
 	col      int
+	// impl is the name of the implementation chosen by the tag's impl option, if any
+	impl string
+	// guard is set by the tag's guard option, which keeps the interface and guards its method calls
+	// with a type assertion to the implementation instead
+	guard bool
+	// guardAs is the value of the guard option, "p" or "v", choosing whether the guard asserts a
+	// pointer or a value of the implementation
+	guardAs string
 }
 type srcFileToBackup struct {
 	filepath string
@@ -76,224 +135,184 @@ func (s *srcFilesToBackup) Add(filepath string) {
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs noifgo and returns its exit status, which is the exit status of the go tool if it was run.
+// Returning instead of exiting lets the deferred clean up run.
+func run() int {
 	if debug {
-		fmt.Printf("main.main() called\n")
-		defer fmt.Printf("main.main() returned\n")
+		fmt.Printf("main.run() called\n")
+		defer fmt.Printf("main.run() returned\n")
 	}
 	var rootFolder string
-	var tag = []byte("noifgo:ifdef")
-	var hiddenFilename = ".noifgo"
-	var srcFilesToBackup srcFilesToBackup
-	var processedInterfaces []taggedInterface
+	var ov *overlay
 
 	// Sets description for this tool
 	flag.Usage = func() {
 		fmt.Printf(helpUsage)
 	}
 	//var args = flag.String("args", "", "Enter go tool arguments, see \"go help build\" for help.")
+	var overlayMode = flag.Bool("overlay", false, "Build through the go tool's -overlay flag instead of rewriting the source files in place.")
+	var bisectMode = flag.Bool("bisect", false, "Find the tagged interfaces whose rewrite makes the build fail.")
+	var bestEffort = flag.Bool("besteffort", false, "With -bisect, build with the interfaces making the build fail left as interfaces.")
 	flag.Parse()
 	args := flag.Args()
 
 	if len(args) == 0 {
 		fmt.Printf(helpUsage)
-		return
+		return 2
 	}
 
 	// - Finds project rootFolder ---------------------------------------------------------
 	wd, err := os.Getwd()
 	if err != nil {
-		fmt.Printf("could not get current working directory: %s\n", err)
+		fmt.Fprintf(os.Stderr, "could not get current working directory: %s\n", err)
 	}
 	if debug {
 		fmt.Printf("current working directory: %s\n", wd)
 	}
-	var hiddenFilepath string
-	hiddenFilepath = filepath.Join(wd, hiddenFilename)
-	fi, _ := os.Open(hiddenFilepath)
-	if fi != nil {
-		rootFolder = wd
-	}
-	fi.Close()
-	if rootFolder == "" {
-		wdParts := strings.Split(wd, string(filepath.Separator))
-		if wdParts == nil {
-			fmt.Printf("Quitting due to working directory is nil\n")
-			os.Exit(1)
-		}
-		for i := 0; i < len(wdParts); i++ {
-			var k int
-			for j := 0; j < i+1; j++ {
-				k = k + len(wdParts[len(wdParts)-1-j])
-			}
-			k = k + i
-			//fmt.Printf("k: %d, wd[:len(wd)-k]: %s\n", k, wd[:len(wd)-k])
-			hiddenFilepath = filepath.Join(wd[:len(wd)-k], hiddenFilename)
-			fi, _ := os.Open(hiddenFilepath)
-			if fi != nil {
-				rootFolder = wd[:len(wd)-k]
-				fi.Close()
-				break
-			}
-			fi.Close()
-		}
+	if rootFolder, err = findRoot(wd); err != nil {
+		fmt.Fprintf(os.Stderr, "could not find project root folder: %s\n", err)
+		return 1
 	}
 	if rootFolder == "" {
-		fmt.Printf(helpNotFoundHiddenFile)
-		return
+		fmt.Fprintf(os.Stderr, helpNotFoundHiddenFile)
+		return 1
 	}
 	if debug {
 		fmt.Printf("rootFolder: %s\n", rootFolder)
 	}
-
-	// - Finds next tagged interface to process ---------------------------------------------
-	for {
-		if debug {
-			fmt.Printf("Finds next tagged interface to process...\n")
-		}
-		taggedIf := nextInterfaceToProcess(rootFolder, &processedInterfaces, tag)
-		// if no more interfaces to process
-		if taggedIf == nil {
-			break
-		}
-		srcFilesToBackup.Add(taggedIf.filepath)
-		if debug {
-			fmt.Printf("taggedIf: %v\n", taggedIf)
-		}
-
-		// - Finds implementations of tagged interface ---------------------------------------
-		impl, err := implByIf(taggedIf.filepath, taggedIf.row, taggedIf.col)
+	if args[0] == "restore" {
+		j, err := readJournal(rootFolder)
 		if err != nil {
-			fmt.Printf("could not get implementation by interface: %s\n", err)
-			break
-		}
-		if debug {
-			fmt.Printf("impl: %v\n", impl)
+			fmt.Fprintf(os.Stderr, "could not read journal: %s\n", err)
+			return 1
 		}
-		srcFilesToBackup.Add(impl.filepath)
-
-		// - Finds tagged interface implementation references and adds them to srcFilesToBackup -------
-		implRefs, err := implRefs(impl.filepath, impl.row, impl.col)
+		restored, err := j.restore()
 		if err != nil {
-			fmt.Printf("could not get implementation references by interface: %s\n", err)
-			break
+			fmt.Fprintf(os.Stderr, "could not restore backed up files: %s\n", err)
+			return 1
 		}
-		for _, implRef := range implRefs {
-			if debug {
-				fmt.Printf("implRef: %v\n", implRef)
+		fmt.Fprintf(os.Stderr, "Restored %d files\n", restored)
+		return 0
+	}
+	if journalExists(rootFolder) {
+		fmt.Fprintf(os.Stderr, "found journal of an interrupted run in %s, run \"noifgo restore\" first\n", rootFolder)
+		return 1
+	}
+	cfg, err := readConfig(rootFolder)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read configuration: %s\n", err)
+		return 1
+	}
+	// Lets an interrupt cancel the run instead of terminating the process, so that the deferred
+	// restore below brings back the source files
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if subcommand, ok := subcommands[args[0]]; ok {
+		if err = subcommand(ctx, cfg, rootFolder, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return failed(ctx)
+		}
+		return 0
+	}
+	var excluded map[string]bool
+	if *bisectMode {
+		if excluded, err = bisect(ctx, cfg, rootFolder); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return failed(ctx)
+		}
+		if !*bestEffort {
+			if len(excluded) > 0 {
+				return 1
 			}
-			srcFilesToBackup.Add(implRef.filepath)
-		}
-		//fmt.Printf("implRefs: %v\n", implRefs)
-
-		// - Finds tagged interface references --------------------------------------------------
-		ifRefs, err := ifRefs(taggedIf.filepath, taggedIf.row, taggedIf.col)
-		if err != nil {
-			fmt.Printf("could not get interface references by interface: %s\n", err)
-			break
+			return 0
 		}
-		for _, ifRef := range ifRefs {
-			if debug {
-				fmt.Printf("ifRef: %v\n", ifRef)
-			}
-			srcFilesToBackup.Add(ifRef.filepath)
+	}
+	var jr *journal
+	if *overlayMode {
+		if ov, err = newOverlay(); err != nil {
+			fmt.Fprintf(os.Stderr, "could not create overlay: %s\n", err)
+			return failed(ctx)
 		}
-
-		// Creates a backup for each source file to backup
-		for i := 0; i < len(srcFilesToBackup); i++ {
-			if srcFilesToBackup[i].backedUp {
-				continue
-			}
-			if err = copyFile(srcFilesToBackup[i].filepath, srcFilesToBackup[i].filepath+".txt"); err != nil {
-				fmt.Printf("could not copy file %s: %s\n", srcFilesToBackup[i].filepath, err)
-				return
+		defer ov.remove()
+	} else {
+		if jr, err = newJournal(rootFolder); err != nil {
+			fmt.Fprintf(os.Stderr, "could not create journal: %s\n", err)
+			return failed(ctx)
+		}
+		// Restores initial state whichever way run returns
+		defer func() {
+			if _, err := jr.restore(); err != nil {
+				fmt.Fprintf(os.Stderr, "could not restore backed up files: %s\n", err)
 			}
-			srcFilesToBackup[i].backedUp = true
-
-		}
-
-		// Adds a prefix to interface implementation that also exports it
-		implPos, err := toPos(impl.filepath, impl.row, impl.col)
-		if err != nil {
-			fmt.Printf("could not get ifImplPos for %s on row %d and column %d\n", impl.filepath, impl.row, impl.col)
-			return
-		}
-		if err = renameRefMany(fmt.Sprintf("%s:#%d", impl.filepath, implPos), implPrefix+impl.name); err != nil {
-			fmt.Printf("could not rename implementation %s in file %s\n", impl.name, impl.filepath)
-			return
-		}
+		}()
+	}
 
-		// Renames interface references to the implementation
-		var lastRefFilepath string
-		var lastRefRow int
-		var lastRowGrowth int
-		for _, ifRef := range ifRefs {
-			if lastRefFilepath == ifRef.filepath && lastRefRow == ifRef.row {
-				ifRef.col = ifRef.col + lastRowGrowth
-			}
-			refPos, err := toPos(ifRef.filepath, ifRef.row, ifRef.col)
-			if err != nil {
-				fmt.Printf("could not get refPos for %s on row %d and column %d\n", ifRef.filepath, ifRef.row, ifRef.col)
-				return
-			}
-			convertTo, err := shouldConvertTo(ifRef.filepath, ifRef.row, taggedIf.name)
-			if err != nil {
-				fmt.Printf("could not parse noifgo tag: %s\n", err)
-				return
-			}
-			var typePrefix string
-			if convertTo == "p" {
-				typePrefix = "*"
-			} else {
-				typePrefix = ""
-			}
-			refAndIfInSamePkg := referencesInSamePkg(ifRef.filepath, taggedIf.filepath)
-			refAndImplInSamePkg := referencesInSamePkg(ifRef.filepath, impl.filepath)
-			var pkgPrefix string
-			if refAndImplInSamePkg {
-				pkgPrefix = ""
-			} else {
-				pkgPrefix = pkgFromFilepath(impl.filepath) + "."
-			}
-			if err = renameRefSingle(ifRef.filepath, taggedIf.name, typePrefix+pkgPrefix+implPrefix+impl.name, refPos, refAndIfInSamePkg, pkgFromFilepath(taggedIf.filepath)); err != nil {
-				return
-			}
-			lastRefFilepath = ifRef.filepath
-			lastRefRow = ifRef.row
-			lastRowGrowth = len(typePrefix) + 9
-		}
-		for _, ifRef := range ifRefs {
-			// Run GoImports on all files where the interface references were renamed to the implementation
-			if err = fixImports(ifRef.filepath); err != nil {
-				return
-			}
-		}
+	// - Rewrites every tagged interface ------------------------------------------------------
+	r := &rewriter{ctx: ctx, cfg: cfg, rootFolder: rootFolder, ov: ov, jr: jr, excluded: excluded}
+	// the go tool reports errors on stderr, which are translated back to the original source files
+	ann, err := r.rewriteForBuild(os.Stderr, wd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return failed(ctx)
 	}
+
 	// Compiles project
 	//argsParts := splitArgs(*args)
-	runGoBuildCmd := exec.Command("go", args...)
-	runGoBuildOutput, err := runGoBuildCmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("Failed: %s\n\n", err)
-	} else {
-		fmt.Printf("Successfully optimized and compiled project\n")
-		fmt.Printf("%s\n\n", runGoBuildOutput)
-	}
-	// Restores initial state
-	for _, backedUpFile := range srcFilesToBackup {
-		if _, err := os.Stat(backedUpFile.filepath + ".txt"); os.IsNotExist(err) {
-			// path/to/whatever does not exist
-			fmt.Printf("backed up file %s not found\n", backedUpFile.filepath)
-			continue
-		}
-		if err = os.Remove(backedUpFile.filepath); err != nil {
-			fmt.Printf("could not remove backed up file %s: %s\n", backedUpFile.filepath, err)
-			return
-		}
-		if err = os.Rename(backedUpFile.filepath+".txt", backedUpFile.filepath); err != nil {
-			fmt.Printf("could not rename backed up file %s from .txt to .go: %s\n", backedUpFile.filepath, err)
-			return
-		}
+	if ov != nil {
+		overlayFp, err := ov.writeJSON()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not write overlay: %s\n", err)
+			return failed(ctx)
+		}
+		if args, err = overlayArgs(args, overlayFp); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return failed(ctx)
+		}
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Interrupted\n")
+		return failed(ctx)
+	}
+	goCmd := exec.CommandContext(ctx, cfg.goBinary(), args...)
+	// an interrupt is passed on to the go tool rather than killing it, so that it stops the programs it
+	// runs, e.g. with go run or go test, instead of leaving them behind holding its stderr
+	goCmd.Cancel = func() error {
+		return goCmd.Process.Signal(os.Interrupt)
+	}
+	goCmd.WaitDelay = goCmdWaitDelay
+	goCmd.Env = cfg.env()
+	goCmd.Stdin = os.Stdin
+	goCmd.Stdout = os.Stdout
+	goCmd.Stderr = ann
+	err = goCmd.Run()
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "Interrupted\n")
+		return failed(ctx)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if exitErr.ExitCode() < 0 {
+			// terminated by a signal
+			return 1
+		}
+		return exitErr.ExitCode()
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "could not run the go tool: %s\n", err)
+		return failed(ctx)
+	}
+	fmt.Fprintf(os.Stderr, "Successfully optimized and compiled project\n")
+	return 0
+}
+
+// failed returns the exit status of a run that failed, which is 130, as set by a shell for a process
+// interrupted by Ctrl-C, if ctx was cancelled by an interrupt and 1 otherwise.
+func failed(ctx context.Context) int {
+	if ctx.Err() != nil {
+		return 130
 	}
+	return 1
 }
 
 // splitArgs parses args and splits it by the space character. It does however allow spaces in double quoted text.
@@ -343,15 +362,19 @@ func splitArgs(args string) (argsSlice []string) {
 }
 
 // shouldConvertTo scans the filepath looking for a special NoIFGo comment on the line before row.
-// The comment should be of the form: //noifgo:{InterfaceName, ptr or value}. Given it finds
-// such a special comment it returns either "p" for pointer or "v" for value and a nil error.
-// If however something errors during the function call an empty string is returned and the error.
-func shouldConvertTo(filepath string, row int, ifName string) (string, error) {
+// The comment should be of the form: //noifgo:{InterfaceName, ptr, value or auto} optionally followed by
+// the implementation to use, e.g. //noifgo:{InterfaceName,p,impl=implName}. Given it finds
+// such a special comment it returns either "p" for pointer, "v" for value or "auto" for deriving
+// either from the implementation, the name of the implementation, which is empty unless given, and
+// a nil error. If the reference is not tagged for the interface an empty string, which is treated
+// like "auto", is returned instead of "p", "v" or "auto".
+// If however something errors during the function call empty strings are returned and the error.
+func shouldConvertTo(ov *overlay, filepath string, row int, ifName string) (convertTo, implName string, err error) {
 	//fmt.Printf("shouldConvertTo called with filepath %s, row: %d, ifName: %s\n", filepath, row, ifName)
 	//defer fmt.Printf("shouldConvertTo returned\n")
-	b, err := ioutil.ReadFile(filepath)
+	b, err := ov.readFile(filepath)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	scanner := bufio.NewScanner(bytes.NewReader(b))
 	curRow := 1
@@ -366,15 +389,19 @@ func shouldConvertTo(filepath string, row int, ifName string) (string, error) {
 	}
 	prevLineParts := bytes.Split(prevLine, []byte("noifgo:"))
 	//fmt.Printf("prevLineParts: %v\n", prevLineParts)
+	if len(prevLineParts) == 1 || bytes.HasPrefix(prevLineParts[1], []byte("ifdef")) {
+		// the reference is not tagged
+		return "", "", nil
+	}
 	if len(prevLineParts) != 2 {
-		return "", fmt.Errorf("could not split line containing noifgo tag in two parts: %s", err)
+		return "", "", fmt.Errorf("could not split line containing noifgo tag in two parts: %s", err)
 	}
-	if prevLineParts[1][0] != '{' {
-		return "", errors.New("noifgo tag malformed: 'noifgo:' should be followed by a '{'")
+	if len(prevLineParts[1]) == 0 || prevLineParts[1][0] != '{' {
+		return "", "", errors.New("noifgo tag malformed: 'noifgo:' should be followed by a '{'")
 	}
 	closingCurlyBrIx := bytes.LastIndex(prevLineParts[1], []byte("}"))
 	if closingCurlyBrIx == -1 {
-		return "", errors.New("noifgo tag malformed: could not find closing '}'")
+		return "", "", errors.New("noifgo tag malformed: could not find closing '}'")
 	}
 	//fmt.Printf("prevLineParts[1][1:closingCurlyBrIx]: %s\n", prevLineParts[1][1:closingCurlyBrIx])
 	keyValuePairs := bytes.Split(prevLineParts[1][1:closingCurlyBrIx], []byte(";"))
@@ -383,123 +410,92 @@ func shouldConvertTo(filepath string, row int, ifName string) (string, error) {
 	for _, kv := range keyValuePairs {
 		keyValuePair := bytes.Split(bytes.TrimSpace(kv), []byte(","))
 		//fmt.Printf("keyValuePair: %s\n", keyValuePair)
-		if len(keyValuePair) != 2 {
-			return "", errors.New("noifgo tag malfored: could not find key value pair, missing ','")
+		if len(keyValuePair) != 2 && len(keyValuePair) != 3 {
+			return "", "", errors.New("noifgo tag malfored: could not find key value pair, missing ','")
 		}
-		if bytes.Equal(keyValuePair[0], []byte(ifName)) {
-			if bytes.Equal(keyValuePair[1], []byte("p")) {
-				return "p", nil
-			}
-			if bytes.Equal(keyValuePair[1], []byte("v")) {
-				return "v", nil
-			}
-			return "", errors.New("noifgo tag malformed: value in key value pair must either be 'p' or 'v'")
+		for k := range keyValuePair {
+			keyValuePair[k] = bytes.TrimSpace(keyValuePair[k])
 		}
-	}
-	return "", fmt.Errorf("noifgo tag malformed: could not find interface %s", ifName)
-}
-
-// referencesInSamePkg compares filepathA with filepathB and returns whether the two files
-// belong to the same package.
-func referencesInSamePkg(filepathA, filepathB string) bool {
-	pathA := filepath.Dir(filepathA)
-	pathB := filepath.Dir(filepathB)
-	return pathA == pathB
-}
-
-// pkgFromFilepath returns the package name from the filepath fp.
-func pkgFromFilepath(fp string) string {
-	path := filepath.Dir(fp)
-	return filepath.Base(path)
-}
-
-// toPos converts the row and col position in filepath to a byte array position used by guru.
-func toPos(filepath string, row, col int) (int, error) {
-	b, err := ioutil.ReadFile(filepath)
-	if err != nil {
-		return 0, err
-	}
-	var fileScannerLastAdvance int
-	var pos int
-	fileScanner := bufio.NewScanner(bytes.NewReader(b))
-	fileScannerSplitFunc := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		advance, token, err = bufio.ScanLines(data, atEOF)
-		fileScannerLastAdvance = advance
-		pos += advance
-		return
-	}
-	// Set the split function for the scanning operation.
-	fileScanner.Split(fileScannerSplitFunc)
-	curRow := 1
-	for fileScanner.Scan() {
-		if curRow != row {
-			curRow++
+		if !bytes.Equal(keyValuePair[0], []byte(ifName)) {
 			continue
 		}
-		pos -= fileScannerLastAdvance
-		pos += col
-		break
+		if len(keyValuePair) == 3 {
+			if !bytes.HasPrefix(keyValuePair[2], []byte("impl=")) || len(keyValuePair[2]) == len("impl=") {
+				return "", "", errors.New("noifgo tag malformed: third value in key value pair must be of the form 'impl=implName'")
+			}
+			implName = string(keyValuePair[2][len("impl="):])
+		}
+		if bytes.Equal(keyValuePair[1], []byte("p")) {
+			return "p", implName, nil
+		}
+		if bytes.Equal(keyValuePair[1], []byte("v")) {
+			return "v", implName, nil
+		}
+		if bytes.Equal(keyValuePair[1], []byte("auto")) {
+			return "auto", implName, nil
+		}
+		return "", "", errors.New("noifgo tag malformed: value in key value pair must either be 'p', 'v' or 'auto'")
 	}
-	// return pos - 1 since col's index starts with 1 instead of 0
-	return pos - 1, nil
+	// the reference is not tagged for the interface
+	return "", "", nil
 }
 
-// copyFile copies the src file to dst. Any existing file will be overwritten and will not
-// copy file attributes.
-func copyFile(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
+// renameRefMany renames the type declared in the file given by filepath on row and col to the name given
+// by to. Every reference to the type in one or more files is renamed as well, including the field names
+// of structs embedding the type.
+func (p *program) renameRefMany(ov *overlay, filepath string, row, col int, to string) error {
+	if debug {
+		fmt.Printf("main.renameRefMany called: filepath: %s, row: %d, col: %d, to: %s\n", filepath, row, col, to)
+		defer fmt.Printf("main.renameRefMany returned\n")
 	}
-	defer in.Close()
-
-	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0666))
+	obj, err := p.objectAt(filepath, row, col)
 	if err != nil {
-		fmt.Printf("could not open file: %s\n", err)
 		return err
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, in)
-	if err != nil {
-		fmt.Printf("could not copy file: %s\n", err)
-		return err
+	if obj.Pkg().Scope().Lookup(to) != nil {
+		return fmt.Errorf("renaming %s to %s conflicts with an existing declaration", obj.Name(), to)
 	}
-	return out.Close()
-}
-
-// renameRefMany renames a reference in one or more files.
-func renameRefMany(filepos, to string) error {
-	if debug {
-		fmt.Printf("main.renameRefMany called: filepos: %s, to: %s\n", filepos, to)
-		defer fmt.Printf("main.renameRefMany returned\n")
+	positions := append(p.renamedUses(obj), p.fset.Position(obj.Pos()))
+	// renames each file from its end so that the remaining positions stay valid
+	sortPositions(positions)
+	var b []byte
+	for i := len(positions) - 1; i >= 0; i-- {
+		pos := positions[i]
+		if i < len(positions)-1 && pos == positions[i+1] {
+			continue
+		}
+		if i == len(positions)-1 || pos.Filename != positions[i+1].Filename {
+			if b, err = ov.readFile(pos.Filename); err != nil {
+				return err
+			}
+		}
+		b = append(b[:pos.Offset], append([]byte(to), b[pos.Offset+len(obj.Name()):]...)...)
+		if i == 0 || pos.Filename != positions[i-1].Filename {
+			if err = ov.writeFile(pos.Filename, b); err != nil {
+				return err
+			}
+		}
 	}
-	return rename.Main(&build.Default, filepos, "", to)
+	return nil
 }
 
-// renameRefSingle renames a single word in a single file.
-func renameRefSingle(filepath, from, to string, pos int, refAndIfInSamePkg bool, ifPkgName string) error {
+// renameRefSingle replaces the reference found between the byte positions pos and end in a single file
+// with to. The reference is either a single word or a word qualified by a package name.
+func renameRefSingle(ov *overlay, filepath, to string, pos, end int) error {
 	if debug {
-		fmt.Printf("main.renameRefSingle called: filepath: %s, from: %s, to: %s, pos: %d, refAndIfInSamePkg: %s, ifPkgName: %s\n", filepath, from, to, pos, refAndIfInSamePkg, ifPkgName)
+		fmt.Printf("main.renameRefSingle called: filepath: %s, to: %s, pos: %d, end: %d\n", filepath, to, pos, end)
 		defer fmt.Printf("main.renameRefSingle returned\n")
 	}
-	b, err := ioutil.ReadFile(filepath)
+	b, err := ov.readFile(filepath)
 	if err != nil {
-		fmt.Printf("could not read file %s\n", err)
+		fmt.Fprintf(os.Stderr, "could not read file %s\n", err)
 		return err
 	}
-	if !refAndIfInSamePkg {
-		// from interactor.Interactor
-		//                 ^ pos
-		// to   interactor.Interactor
-		//      ^ pos
-		pos = pos - 1 - len(ifPkgName)
-		// from Interactor
-		// to   interactor.Interactor
-		from = ifPkgName + "." + from
-	}
+	// from interactor.Interactor
+	//      ^ pos                ^ end
+	// to   *impl.NoIFGoImpl
 	//fmt.Printf("b[:pos]: %s\n", string(b[:pos+1]))
-	sizeChg := len(to) - len(from)
+	sizeChg := len(to) - (end - pos)
 	newb := make([]byte, len(b)+sizeChg, len(b)+sizeChg)
 	for k, v := range b {
 		if k == pos {
@@ -513,318 +509,44 @@ func renameRefSingle(filepath, from, to string, pos int, refAndIfInSamePkg bool,
 		newb[pos+k] = v
 	}
 	//fmt.Printf("newb after adding to word: %s\n", string(newb))
-	sAfterWord := b[pos+len(from):]
+	sAfterWord := b[end:]
 	for i := 0; i < len(sAfterWord); i++ {
 		newb[pos+len(to)+i] = sAfterWord[i]
 	}
 	//fmt.Printf("%s\n", string(newb))
-	in, err := os.Open(filepath)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-
-	// wraps newb in a reader
-	src := bytes.NewReader(newb)
-
 	// writes the content of newb to the file given by filepath
-	dst, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0666))
-	if err != nil {
-		fmt.Printf("could not open file: %s\n", err)
-		return err
-	}
-	defer dst.Close()
-	_, err = io.Copy(dst, src)
-	if err != nil {
-		fmt.Printf("could not copy file: %s\n", err)
+	if err = ov.writeFile(filepath, newb); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write file: %s\n", err)
 		return err
 	}
 	return nil
 }
 
-// implByIf uses guru to find the interface implementation for an interface given by the filepath, row and col arguments.
-// If more than one implementation is encountered it returns an error and a nil ifImplementation.
-func implByIf(fp string, row, col int) (*ifImplementation, error) {
-	if debug {
-		fmt.Printf("main.implByIf called: fp: %s, row: %d, col %d\n", fp, row, col)
-		defer fmt.Printf("main.implByIf returned\n")
-	}
-	interfacePos, err := toPos(fp, row, col)
-	if err != nil {
-		return nil, err
-	}
-	if debug {
-		fmt.Printf("interfacePos: %d\n", interfacePos)
-	}
-	findIfImplCmd := exec.Command("guru", "implements", fmt.Sprintf("%s:#%d", fp, interfacePos))
-
-	// findIfImplCmdOutput example
-	// ===========================
-	// findIfImplCmd output: /Users/tobias/Cloud Storage/Sync/Tobias.Strandberg/Projects/go/src/private/p/expedition/noifgo/cmd/noifgo/if.go:4.6-4.10: interface type Adder
-	// /Users/tobias/Cloud Storage/Sync/Tobias.Strandberg/Projects/go/src/private/p/expedition/noifgo/cmd/noifgo/if.go:14.6-14.8:        is implemented by struct type Lol
-	// /Users/tobias/Cloud Storage/Sync/Tobias.Strandberg/Projects/go/src/private/p/expedition/noifgo/cmd/noifgo/if.go:8.6-8.10:         is implemented by struct type private/p/expedition/noifgo/example/lib/interaction.interactor
-	findIfImplCmdOutput, err := findIfImplCmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("could not run findIfImplCmd: %s\n", err)
-		return nil, err
-	}
-	//fmt.Printf("findIfImplCmd output: %s\n", findIfImplCmdOutput)
-	ifImplBytesScanner := bufio.NewScanner(bytes.NewReader(findIfImplCmdOutput))
-	// skips the first line
-	tooManyIfImpls := false
-	var impl ifImplementation
-	found := false
-	ifImplBytesScanner.Scan()
-	for ifImplBytesScanner.Scan() {
-		if bytes.Contains(ifImplBytesScanner.Bytes(), []byte("_test.go")) {
-			continue
-		}
-		if found {
-			tooManyIfImpls = true
-			break
-		}
-		// [...noifgo/if.go 14.5-14.8       "is implemented by struct type Lol"]
-		ifImplBytesParts := bytes.Split(ifImplBytesScanner.Bytes(), []byte(":"))
-		if len(ifImplBytesParts) != 3 {
-			fmt.Printf("ifImplBytesParts does not contain three parts\n")
-			continue
-		}
-		impl = ifImplementation{
-			filepath: string(ifImplBytesParts[0]),
-		}
-		// [14.5 14.8]
-		rowColDashParts := bytes.Split(ifImplBytesParts[1], []byte("-"))
-		if len(rowColDashParts) != 2 {
-			fmt.Printf("length of rowColDashParts not equal to 2\n")
-			continue
-		}
-		// [14 5]
-		rowColParts := bytes.Split(rowColDashParts[0], []byte("."))
-		if len(rowColParts) != 2 {
-			fmt.Printf("length of rowColParts not equal to 2\n")
-			continue
-		}
-		// row is 14
-		impl.row, err = strconv.Atoi(string(rowColParts[0]))
-		if err != nil {
-			fmt.Printf("could not parse row int from %s\n", rowColParts[0])
-			continue
-		}
-		// col is 5
-		impl.col, err = strconv.Atoi(string(rowColParts[1]))
-		if err != nil {
-			fmt.Printf("could not parse column int from %s\n", rowColParts[1])
-			continue
-		}
-		// is implemented by struct type Lol
-		//                              ^ ifImplPos
-		ifImplPos := bytes.LastIndex(ifImplBytesParts[2], []byte(" "))
-		if ifImplPos == -1 {
-			fmt.Printf("could not find implementation name' '\n")
-			continue
-		}
-		// from '/a/b/pkg.object' to 'pkg.object'
-		dirtyImplName := filepath.Base(string(ifImplBytesParts[2][ifImplPos+1:]))
-		// from 'pkg.object' to 'object'
-		dirtyImplNameParts := strings.Split(dirtyImplName, ".")
-		if len(dirtyImplNameParts) == 1 {
-			impl.name = dirtyImplNameParts[0]
-		} else {
-			impl.name = dirtyImplNameParts[1]
-		}
-		found = true
-		// adds implementation file to srcFilesToBackup
-		//srcFilesToBackup.Add(impl.filepath)
-		//fmt.Printf("ifImplName: %s\n", ifImplBytesParts[2][ifImplPos+1:])
-	}
-	if ifImplBytesScanner.Err() != nil {
-		fmt.Printf("could not scan interface implementation bytes: %s\n", ifImplBytesScanner.Err())
-		return nil, ifImplBytesScanner.Err()
-	}
-	if tooManyIfImpls {
-		return nil, fmt.Errorf("Too many interface implementations")
-	}
-
-	return &impl, nil
-}
-
-// implRefs uses guru to find references to interface implementations in the file given by filepath.
-// It returns a nil slice and an error if an error occurs.
-func implRefs(filepath string, row, col int) ([]ifImplementation, error) {
-	if debug {
-		fmt.Printf("main.implRefs called: filepath: %s, row: %d, col %d\n", filepath, row, col)
-		defer fmt.Printf("main.implRefs returned\n")
-	}
-	ifImplRefPos, err := toPos(filepath, row, col)
-	if err != nil {
-		fmt.Printf("could not get position from %s:%d.%d reference\n", filepath, row, col)
-		return nil, fmt.Errorf("could not get position from %s:%d.%d reference", filepath, row, col)
-	}
-	if debug {
-		fmt.Printf("ifImplRefPos: %d\n", ifImplRefPos)
-	}
-	findIfImplRefsCmd := exec.Command(
-		"guru",
-		"referrers",
-		fmt.Sprintf(
-			"%s:#%d",
-			filepath,
-			ifImplRefPos,
-		),
-	)
-	findIfImplRefsCmdOutput, err := findIfImplRefsCmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("could not run findIfImplRefsCmd: %s\n", err)
-	}
-	//fmt.Printf("findIfImplRefsCmdOutput: %s\n", findIfImplRefsCmdOutput)
-	var impls []ifImplementation
-	ifImplRefsBytesScanner := bufio.NewScanner(bytes.NewReader(findIfImplRefsCmdOutput))
-	// skips the first line
-	ifImplRefsBytesScanner.Scan()
-	for ifImplRefsBytesScanner.Scan() {
-		if bytes.Contains(ifImplRefsBytesScanner.Bytes(), []byte("_test.go")) {
-			continue
-		}
-		ifImplRefsBytesParts := bytes.Split(ifImplRefsBytesScanner.Bytes(), []byte(":"))
-		if len(ifImplRefsBytesParts) != 3 {
-			fmt.Printf("ifImplRefsBytesParts does not contain three parts\n")
-			continue
-		}
-		impl := ifImplementation{
-			filepath: string(ifImplRefsBytesParts[0]),
-		}
-		rowColDashParts := bytes.Split(ifImplRefsBytesParts[1], []byte("-"))
-		if len(rowColDashParts) != 2 {
-			fmt.Printf("length of rowColDashParts not equal to 2\n")
-			continue
-		}
-		rowColParts := bytes.Split(rowColDashParts[0], []byte("."))
-		if len(rowColParts) != 2 {
-			fmt.Printf("length of rowColParts not equal to 2\n")
-			continue
-		}
-		rowColEndParts := bytes.Split(rowColDashParts[1], []byte("."))
-		if len(rowColEndParts) != 2 {
-			fmt.Printf("length of rowColEndParts not equal to 2\n")
-			continue
-		}
-		impl.row, err = strconv.Atoi(string(rowColParts[0]))
-		if err != nil {
-			fmt.Printf("could not parse row int from %s\n", rowColParts[0])
-			continue
-		}
-		impl.col, err = strconv.Atoi(string(rowColParts[1]))
-		if err != nil {
-			fmt.Printf("could not parse column int from %s\n", rowColParts[1])
-			continue
-		}
-		endCol, err := strconv.Atoi(string(rowColEndParts[1]))
-		if err != nil {
-			fmt.Printf("could not parse end column int from %s\n", rowColEndParts[1])
-			continue
-		}
-		impl.name = string(ifImplRefsBytesParts[2][impl.col : endCol+1])
-		//fmt.Printf("impl.name: %s\n", impl.name)
-		impls = append(impls, impl)
-	}
-	if ifImplRefsBytesScanner.Err() != nil {
-		fmt.Printf("could not scan interface implementation references bytes: %s\n", ifImplRefsBytesScanner.Err())
-		return nil, ifImplRefsBytesScanner.Err()
-	}
-	return impls, nil
-}
-
-// ifRefs uses guru to find interface references. Filepath is the file the interface definition resides in
-// and row and col specifies the position in that file where the definition is located. If an error occurs
-// a nil slice and an error are returned.
-func ifRefs(filepath string, row, col int) ([]reference, error) {
-	if debug {
-		fmt.Printf("main.ifRefs called: filepath: %s, row: %d, col %d\n", filepath, row, col)
-		defer fmt.Printf("main.ifRefs returned\n")
-	}
-	interfacePos, err := toPos(filepath, row, col)
-	if err != nil {
-		fmt.Printf("could not get position from %s:%d.%d reference\n", filepath, row, col)
-		return nil, fmt.Errorf("could not get position from %s:%d.%d reference", filepath, row, col)
-	}
-	if debug {
-		fmt.Printf("interfacePos: %d\n", interfacePos)
-	}
-	findIfRefsCmd := exec.Command("guru", "referrers", fmt.Sprintf("%s:#%d", filepath, interfacePos))
-
-	// findIfRefsCmdOutput example
-	// ===========================
-	// findIfRefsCmdOutput: /Users/tobias/Cloud Storage/Sync/Tobias.Strandberg/Projects/go/src/private/p/expedition/noifgo/cmd/noifgo/if.go:4.6-4.10: references to type Adder interface{Add(a int, b int) int}
-	// /Users/tobias/Cloud Storage/Sync/Tobias.Strandberg/Projects/go/src/private/p/expedition/noifgo/cmd/noifgo/main.go:236.8-236.12:   adder Adder
-	findIfRefsCmdOutput, err := findIfRefsCmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("could not run findIfRefsCmd: %s\n", err)
-	}
-	//fmt.Printf("findIfRefsCmdOutput: %s\n", findIfRefsCmdOutput)
-	var refs []reference
-	ifRefsBytesScanner := bufio.NewScanner(bytes.NewReader(findIfRefsCmdOutput))
-	// skips the first line
-	ifRefsBytesScanner.Scan()
-	for ifRefsBytesScanner.Scan() {
-		if bytes.Contains(ifRefsBytesScanner.Bytes(), []byte("_test.go")) {
-			continue
-		}
-		ifRefsBytesParts := bytes.Split(ifRefsBytesScanner.Bytes(), []byte(":"))
-		if len(ifRefsBytesParts) != 3 {
-			fmt.Printf("ifRefsBytesParts does not contain three parts\n")
-			continue
-		}
-		ref := reference{}
-		ref.filepath = string(ifRefsBytesParts[0])
-		rowColDashParts := bytes.Split(ifRefsBytesParts[1], []byte("-"))
-		if len(rowColDashParts) != 2 {
-			fmt.Printf("length of rowColDashParts not equal to 2\n")
-			continue
-		}
-		rowColParts := bytes.Split(rowColDashParts[0], []byte("."))
-		if len(rowColParts) != 2 {
-			fmt.Printf("length of rowColParts not equal to 2\n")
-			continue
-		}
-		ref.row, err = strconv.Atoi(string(rowColParts[0]))
-		if err != nil {
-			fmt.Printf("could not parse row int from %s\n", rowColParts[0])
-			continue
-		}
-		ref.col, err = strconv.Atoi(string(rowColParts[1]))
-		if err != nil {
-			fmt.Printf("could not parse column int from %s\n", rowColParts[1])
-			continue
-		}
-		refs = append(refs, ref)
-	}
-	if ifRefsBytesScanner.Err() != nil {
-		fmt.Printf("could not scan interface references bytes: %s\n", ifRefsBytesScanner.Err())
-		return nil, ifRefsBytesScanner.Err()
-	}
-
-	return refs, nil
-}
-
 // nextInterfaceToProcess traverses the file and folder structure recursively starting in rootFolder looking for
-// tagged interfaces. Each tagged interface it encounters it stores in processedInterfaces to prevent it from
-// returning the same interface twice. When there are no more tagged interfaces to return it returns nil.
-func nextInterfaceToProcess(rootFolder string, processedInterfaces *[]taggedInterface, tag []byte) *taggedInterface {
+// tagged interfaces in the files searched according to cfg. Each tagged interface it encounters it stores in
+// processedInterfaces to prevent it from returning the same interface twice. When there are no more tagged
+// interfaces to return it returns nil.
+func nextInterfaceToProcess(ov *overlay, cfg *config, rootFolder string, processedInterfaces *[]taggedInterface, tag []byte) *taggedInterface {
 	var taggedIf *taggedInterface
+	errFound := errors.New("tagged interface found")
 	filepath.Walk(rootFolder, func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() {
+			if path != rootFolder && cfg.excluded(rootFolder, path) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		if filepath.Ext(info.Name()) != ".go" {
+		if filepath.Ext(info.Name()) != ".go" || !cfg.searched(rootFolder, path) {
 			return nil
 		}
-		b, err := ioutil.ReadFile(path)
+		b, err := ov.readFile(path)
 		if err != nil {
-			fmt.Printf("could not read file: %s\n", path)
+			fmt.Fprintf(os.Stderr, "could not read file: %s\n", path)
 		}
 		var fileSlicePos int
 		//var srcFileScannerLastAdvance int
 		found := false
+		var opts map[string]string
 		var sb []byte
 		srcFileScanner := bufio.NewScanner(bytes.NewReader(b))
 		srcFileScannerSplitFunc := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -840,8 +562,9 @@ func nextInterfaceToProcess(rootFolder string, processedInterfaces *[]taggedInte
 			row++
 			//fmt.Printf("fileSlicePos: %d\n", fileSlicePos)
 			sb = srcFileScanner.Bytes()
-			if bytes.Contains(sb, tag) {
+			if tagIx := bytes.Index(sb, tag); tagIx != -1 {
 				found = true
+				opts = ifdefOptions(sb[tagIx+len(tag):])
 				continue
 			}
 			if !found {
@@ -887,39 +610,77 @@ func nextInterfaceToProcess(rootFolder string, processedInterfaces *[]taggedInte
 			if ifProcessed {
 				continue
 			}
+			guardAs, guard := opts["guard"]
 			taggedIf = &taggedInterface{
 				name:     interfaceName,
 				filepath: path,
 				row:      row,
 				col:      6,
+				impl:     opts["impl"],
+				guard:    guard,
+				guardAs:  guardAs,
 			}
 			// fmt.Printf("taggedIf.name: %s\n", taggedIf.name)
 			*processedInterfaces = append(*processedInterfaces, *taggedIf)
-			return nil
+			// stops the walk so that a tagged interface in a later file does not replace this one
+			return errFound
 		}
 		return nil
 	})
 	return taggedIf
 }
 
-// fixImports cleans up import statements in the file given by filepath.
-func fixImports(filepath string) error {
-	b, err := imports.Process(filepath, nil, nil)
+// ifdefOptions parses the space separated options following the noifgo:ifdef tag, e.g. impl=implName,
+// into a map. An option without a value is mapped to an empty string.
+func ifdefOptions(b []byte) map[string]string {
+	opts := make(map[string]string)
+	for _, opt := range bytes.Fields(b) {
+		kv := bytes.SplitN(opt, []byte("="), 2)
+		if len(kv) == 1 {
+			opts[string(kv[0])] = ""
+			continue
+		}
+		opts[string(kv[0])] = string(kv[1])
+	}
+	return opts
+}
+
+// fixImports cleans up import statements in the file given by filepath. Beforehand it adds an import for
+// each import path in addImports, named by the mapped name unless the import path implies it.
+func fixImports(ov *overlay, filepath string, addImports map[string]string) error {
+	src, err := ov.readFile(filepath)
 	if err != nil {
-		fmt.Printf("could not fix imports for file %s: %s\n", filepath, err)
+		fmt.Fprintf(os.Stderr, "could not read file %s: %s\n", filepath, err)
 		return err
 	}
-	src := bytes.NewReader(b)
-	// writes the content of b to the file given by filepath
-	dst, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0666))
+	if len(addImports) > 0 {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, filepath, src, parser.ParseComments)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not parse file %s: %s\n", filepath, err)
+			return err
+		}
+		for importPath, name := range addImports {
+			if name == path.Base(importPath) {
+				name = ""
+			}
+			astutil.AddNamedImport(fset, f, name, importPath)
+		}
+		var buf bytes.Buffer
+		if err = format.Node(&buf, fset, f); err != nil {
+			fmt.Fprintf(os.Stderr, "could not format file %s: %s\n", filepath, err)
+			return err
+		}
+		src = buf.Bytes()
+	}
+	b, err := imports.Process(filepath, src, nil)
 	if err != nil {
-		fmt.Printf("could not open file: %s\n", err)
+		fmt.Fprintf(os.Stderr, "could not fix imports for file %s: %s\n", filepath, err)
 		return err
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, src)
-	if err != nil {
-		fmt.Printf("could not copy file: %s\n", err)
+	// writes the content of b to the file given by filepath
+	if err = ov.writeFile(filepath, b); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write file: %s\n", err)
 		return err
 	}
 	return nil
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const helpOpt = `Usage:
+
+	noifgo opt [packages]
+
+Opt compiles the packages twice with -gcflags=-m=2, first from the untouched source files and then from
+the source files with every tagged interface rewritten the same way a build does, and compares the
+inlining and escape analysis decisions the compiler reports for each. It lists
+
+	the call sites inlined only after the rewrite,
+	the call sites inlined only before the rewrite,
+	the heap allocations the rewrite removed and
+	the heap allocations the rewrite added,
+
+each at its position in the original source files and attributed to the noifgo tags that caused it.
+Without packages every package of the project is compiled. The source files are left untouched.
+
+`
+
+// optDiagPattern matches a diagnostic of the compiler, e.g. ./app/main.go:16:27: inlining call to lib.F.
+var optDiagPattern = regexp.MustCompile(`^([^\s:]+\.go):(\d+):\d+: (.*)$`)
+
+// optDiag is an inlining or escape analysis decision reported by the compiler on a row of a source file,
+// its message stripped of the implementation prefix so that it reads the same before and after the
+// rewrite.
+type optDiag struct {
+	filepath string
+	row      int
+	msg      string
+}
+
+// optCategory is a kind of change of the compiler's decisions listed by the opt command.
+type optCategory struct {
+	title string
+	// inlining is true for inlining decisions and false for heap allocations
+	inlining bool
+	// after is true for decisions found only after the rewrite and false for those found only before
+	after bool
+}
+
+var optCategories = []optCategory{
+	{title: "Call sites inlined after the rewrite", inlining: true, after: true},
+	{title: "Call sites no longer inlined after the rewrite", inlining: true, after: false},
+	{title: "Heap allocations removed by the rewrite", inlining: false, after: false},
+	{title: "Heap allocations added by the rewrite", inlining: false, after: true},
+}
+
+// opt implements the "noifgo opt" command.
+func opt(ctx context.Context, cfg *config, rootFolder string, args []string) error {
+	fs := flag.NewFlagSet("opt", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Printf(helpOpt)
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	pkgs := fs.Args()
+	if len(pkgs) == 0 {
+		dir = rootFolder
+		pkgs = loadPatterns(ctx, cfg, rootFolder)
+	}
+
+	fmt.Fprintf(os.Stderr, "Compiling the original code\n")
+	before, err := compileDiags(ctx, cfg, dir, nil, nil, pkgs)
+	if err != nil {
+		return err
+	}
+	r, ann, err := rewriteInOverlay(ctx, cfg, rootFolder, dir)
+	if err != nil {
+		return err
+	}
+	defer r.ov.remove()
+	fmt.Fprintf(os.Stderr, "Compiling the rewritten code\n")
+	after, err := compileDiags(ctx, cfg, dir, r.ov, ann, pkgs)
+	if err != nil {
+		return err
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	changes := 0
+	for _, category := range optCategories {
+		found, missing := after, before
+		if !category.after {
+			found, missing = before, after
+		}
+		var diags []optDiag
+		for _, d := range subtractDiags(found, missing) {
+			if strings.HasPrefix(d.msg, "inlining call to ") == category.inlining {
+				diags = append(diags, d)
+			}
+		}
+		if len(diags) == 0 {
+			continue
+		}
+		fmt.Printf("%s:\n", category.title)
+		for _, d := range diags {
+			fmt.Printf("\t%s:%d: %s\n", relPath(wd, d.filepath), d.row, d.msg)
+			causes := r.causes(wd, d.filepath, d.row, ann.originals)
+			if len(causes) == 0 {
+				causes = []string{"the rewrite of the packages it depends on"}
+			}
+			for _, cause := range causes {
+				fmt.Printf("\t\tcaused by %s\n", cause)
+			}
+		}
+		changes += len(diags)
+	}
+	if changes == 0 {
+		fmt.Fprintf(os.Stderr, "The rewrite changes no inlining or escape analysis decision\n")
+	}
+	return nil
+}
+
+// compileDiags builds the packages pkgs in the folder dir with -gcflags=-m=2, from the source files
+// rewritten in ov if ov is not nil, and returns the inlined calls and the heap allocations the compiler
+// reports. The positions of the diagnostics are translated by ann unless it is nil.
+func compileDiags(ctx context.Context, cfg *config, dir string, ov *overlay, ann *annotator, pkgs []string) ([]optDiag, error) {
+	// the compiled packages are discarded so that no binary is left behind, which also lets go build
+	// build several packages and packages that are not main packages
+	buildArgs := []string{"build", "-o", os.DevNull, "-gcflags=-m=2"}
+	if ov != nil {
+		overlayFp, err := ov.writeJSON()
+		if err != nil {
+			return nil, fmt.Errorf("could not write overlay: %s", err)
+		}
+		buildArgs = append(buildArgs, "-overlay="+overlayFp)
+	}
+	cmd := exec.CommandContext(ctx, cfg.goBinary(), append(buildArgs, pkgs...)...)
+	cmd.Dir = dir
+	cmd.Env = cfg.env()
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, errors.New("Interrupted")
+	}
+	var lines []string
+	for _, line := range splitLines(out) {
+		if ann != nil {
+			// an annotated line is followed by the lines naming its causes, which are not diagnostics
+			line = splitLines([]byte(ann.annotate(line)))[0]
+		}
+		lines = append(lines, line)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("go build failed: %s\n%s", err, strings.TrimRight(strings.Join(lines, ""), "\n"))
+	}
+
+	var diags []optDiag
+	for _, line := range lines {
+		m := optDiagPattern.FindStringSubmatch(strings.TrimRight(line, "\n"))
+		if m == nil {
+			continue
+		}
+		msg := m[3]
+		// the explanations of -m=2 end with a colon and are followed by indented lines
+		if strings.HasSuffix(msg, ":") {
+			continue
+		}
+		if !strings.HasPrefix(msg, "inlining call to ") && !strings.HasSuffix(msg, " escapes to heap") && !strings.HasPrefix(msg, "moved to heap: ") {
+			continue
+		}
+		fp := outputPath(dir, m[1])
+		row, _ := strconv.Atoi(m[2])
+		diags = append(diags, optDiag{filepath: fp, row: row, msg: cfg.stripImplPrefix(msg)})
+	}
+	return diags, nil
+}
+
+// subtractDiags returns the diagnostics in a which are not in b, counting repeated diagnostics, sorted by
+// filepath and row.
+func subtractDiags(a, b []optDiag) []optDiag {
+	count := make(map[optDiag]int)
+	for _, d := range b {
+		count[d]++
+	}
+	var diff []optDiag
+	for _, d := range a {
+		if count[d] > 0 {
+			count[d]--
+			continue
+		}
+		diff = append(diff, d)
+	}
+	sort.SliceStable(diff, func(i, j int) bool {
+		if diff[i].filepath != diff[j].filepath {
+			return diff[i].filepath < diff[j].filepath
+		}
+		return diff[i].row < diff[j].row
+	})
+	return diff
+}
+
+// outputPath returns the absolute filepath of the file given by fp in the output of the go tool run in
+// the folder dir. The go tool replays the output of cached builds with the paths relative to the folder
+// the build was run in, so a relative fp is looked up in dir and then in the folders above it.
+func outputPath(dir, fp string) string {
+	if filepath.IsAbs(fp) {
+		return fp
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, fp)); err == nil {
+			return filepath.Join(d, fp)
+		}
+		if d == filepath.Dir(d) {
+			return filepath.Join(dir, fp)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// overlay keeps rewritten copies of source files in a temporary folder. The go tool is pointed at
+// the copies through its -overlay flag, which means the original source files are never modified.
+// A nil overlay reads and writes the original source files in place.
+type overlay struct {
+	dir     string
+	replace map[string]string
+}
+
+// newOverlay creates an empty overlay backed by a new temporary folder.
+func newOverlay() (*overlay, error) {
+	dir, err := ioutil.TempDir("", "noifgo")
+	if err != nil {
+		return nil, err
+	}
+	return &overlay{dir: dir, replace: make(map[string]string)}, nil
+}
+
+// readFile returns the content of the file given by fp. If the overlay holds a rewritten copy of
+// the file the copy is returned instead.
+func (o *overlay) readFile(fp string) ([]byte, error) {
+	if o != nil {
+		if copyFp, ok := o.replace[fp]; ok {
+			return ioutil.ReadFile(copyFp)
+		}
+	}
+	return ioutil.ReadFile(fp)
+}
+
+// writeFile sets b as the new content of the file given by fp. The original file is only written
+// to if the overlay is nil.
+func (o *overlay) writeFile(fp string, b []byte) error {
+	if o == nil {
+		return ioutil.WriteFile(fp, b, os.FileMode(0666))
+	}
+	copyFp, ok := o.replace[fp]
+	if !ok {
+		// prefixes the copy with a sequence number since files in different folders may share a name
+		copyFp = filepath.Join(o.dir, strconv.Itoa(len(o.replace))+"_"+filepath.Base(fp))
+		o.replace[fp] = copyFp
+	}
+	return ioutil.WriteFile(copyFp, b, os.FileMode(0666))
+}
+
+// contents returns the content of every rewritten file keyed by the original filepath.
+func (o *overlay) contents() (map[string][]byte, error) {
+	if o == nil {
+		return nil, nil
+	}
+	m := make(map[string][]byte, len(o.replace))
+	for fp, copyFp := range o.replace {
+		b, err := ioutil.ReadFile(copyFp)
+		if err != nil {
+			return nil, err
+		}
+		m[fp] = b
+	}
+	return m, nil
+}
+
+// writeJSON writes the overlay description expected by the go tool's -overlay flag to the overlay
+// folder and returns its filepath.
+func (o *overlay) writeJSON() (string, error) {
+	b, err := json.Marshal(struct{ Replace map[string]string }{Replace: o.replace})
+	if err != nil {
+		return "", err
+	}
+	fp := filepath.Join(o.dir, "overlay.json")
+	if err = ioutil.WriteFile(fp, b, os.FileMode(0666)); err != nil {
+		return "", fmt.Errorf("could not write overlay file %s: %s", fp, err)
+	}
+	return fp, nil
+}
+
+// remove deletes the overlay folder including every rewritten copy.
+func (o *overlay) remove() error {
+	if o == nil {
+		return nil
+	}
+	return os.RemoveAll(o.dir)
+}
+
+// overlayArgs inserts the -overlay flag pointing at overlayFp into the go tool arguments args. The
+// flag is only understood by go commands accepting build flags, for other commands an error is returned.
+func overlayArgs(args []string, overlayFp string) ([]string, error) {
+	switch args[0] {
+	case "build", "install", "run", "test", "vet", "list":
+	default:
+		return nil, fmt.Errorf("go %s does not accept the -overlay flag", args[0])
+	}
+	newArgs := make([]string, 0, len(args)+1)
+	newArgs = append(newArgs, args[0], "-overlay="+overlayFp)
+	return append(newArgs, args[1:]...), nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/types"
+	"os"
+	"sort"
+	"strings"
+)
+
+// preflight checks every tagged interface and its references before any source file is touched. Each
+// problem found is printed as a file:line diagnostic and an error is returned if there were any.
+func (r *rewriter) preflight() error {
+	prog, err := loadProgram(r.ctx, r.cfg, r.rootFolder, r.ov)
+	if err != nil {
+		return fmt.Errorf("could not load project packages: %s", err)
+	}
+	var processedInterfaces []taggedInterface
+	problems := 0
+	imports := make(map[importEdge]string)
+	for {
+		taggedIf := nextInterfaceToProcess(r.ov, r.cfg, r.rootFolder, &processedInterfaces, ifdefTag)
+		if taggedIf == nil {
+			break
+		}
+		if r.excluded[taggedIf.key()] {
+			continue
+		}
+		for _, diag := range prog.checkInterface(taggedIf, imports) {
+			fmt.Fprintf(os.Stderr, "%s\n", diag)
+			problems++
+		}
+	}
+	for _, diag := range prog.checkImportCycles(imports) {
+		fmt.Fprintf(os.Stderr, "%s\n", diag)
+		problems++
+	}
+	if problems > 0 {
+		return errors.New("preflight check failed, no source files were touched")
+	}
+	return nil
+}
+
+// checkInterface returns a diagnostic for each problem found with taggedIf and its tagged references.
+// Each import the rewrite adds is recorded in imports together with the tag causing it.
+func (p *program) checkInterface(taggedIf *taggedInterface, imports map[importEdge]string) []string {
+	ifPos := fmt.Sprintf("%s:%d", taggedIf.filepath, taggedIf.row-1)
+	_, iface, err := p.interfaceAt(taggedIf.filepath, taggedIf.row, taggedIf.col)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %s", ifPos, err)}
+	}
+	if taggedIf.guard {
+		if taggedIf.guardAs != "" && taggedIf.guardAs != "p" && taggedIf.guardAs != "v" {
+			return []string{fmt.Sprintf("%s: noifgo tag malformed: guard option must either be 'p' or 'v'", ifPos)}
+		}
+		impl, err := p.implByIf(taggedIf.filepath, taggedIf.row, taggedIf.col, taggedIf.impl)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %s", ifPos, err)}
+		}
+		if taggedIf.guardAs == "v" {
+			implObj, err := p.objectAt(impl.filepath, impl.row, impl.col)
+			if err != nil {
+				return []string{fmt.Sprintf("%s: %s", ifPos, err)}
+			}
+			if !types.Implements(implObj.Type(), iface) {
+				return []string{fmt.Sprintf("%s: guard=v asserts a value of %s, but only a pointer implements %s%s, use p",
+					ifPos, impl.name, taggedIf.name, ptrRecvReason(implObj.(*types.TypeName), iface))}
+			}
+		}
+		tn, _, _ := p.interfaceAt(taggedIf.filepath, taggedIf.row, taggedIf.col)
+		for _, c := range p.guardedCalls(tn) {
+			p.recordImport(imports, c.filepath, impl, fmt.Sprintf("%s: guarding the calls on %s with %s", ifPos, taggedIf.name, impl.name))
+		}
+		return nil
+	}
+	ifRefs, err := p.ifRefs(taggedIf.filepath, taggedIf.row, taggedIf.col)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %s", ifPos, err)}
+	}
+	var diags []string
+	// byName holds the implementation chosen by each impl name, several names may choose the same one
+	byName := make(map[string]*ifImplementation)
+	for _, ifRef := range ifRefs {
+		// diagnostics point at the tag on the row above the reference, or at the reference if it has none
+		pos := fmt.Sprintf("%s:%d", ifRef.filepath, ifRef.row-1)
+		convertTo, implName, err := shouldConvertTo(nil, ifRef.filepath, ifRef.row, taggedIf.name)
+		if err != nil {
+			diags = append(diags, fmt.Sprintf("%s: %s", pos, err))
+			continue
+		}
+		tagged := convertTo != ""
+		if !tagged {
+			pos = fmt.Sprintf("%s:%d", ifRef.filepath, ifRef.row)
+		}
+		if why := p.changedMeaning(ifRef); why != "" && !tagged {
+			diags = append(diags, fmt.Sprintf("%s: the untagged reference to %s cannot be replaced since %s, tag it to replace it anyway",
+				pos, taggedIf.name, why))
+			continue
+		}
+		if implName == "" {
+			implName = taggedIf.impl
+		}
+		if convertTo == "" {
+			convertTo = p.cfg.Default
+		}
+		impl, ok := byName[implName]
+		if !ok {
+			if impl, err = p.implByIf(taggedIf.filepath, taggedIf.row, taggedIf.col, implName); err != nil {
+				diags = append(diags, fmt.Sprintf("%s: %s", pos, err))
+				continue
+			}
+			byName[implName] = impl
+		}
+		p.recordImport(imports, ifRef.filepath, impl, fmt.Sprintf("%s: replacing %s by %s", pos, taggedIf.name, impl.name))
+		if convertTo == "auto" {
+			if _, err = p.autoConvertTo(taggedIf, impl); err != nil {
+				diags = append(diags, fmt.Sprintf("%s: %s", pos, err))
+			}
+			continue
+		}
+		if convertTo != "v" {
+			continue
+		}
+		implObj, err := p.objectAt(impl.filepath, impl.row, impl.col)
+		if err != nil {
+			diags = append(diags, fmt.Sprintf("%s: %s", pos, err))
+			continue
+		}
+		if types.Implements(implObj.Type(), iface) {
+			continue
+		}
+		how := fmt.Sprintf("//noifgo:{%s,v}", taggedIf.name)
+		if !tagged {
+			how = "the default v"
+		}
+		diags = append(diags, fmt.Sprintf("%s: %s replaces the reference by a value of %s, but only a pointer implements %s%s, use p",
+			pos, how, impl.name, taggedIf.name, ptrRecvReason(implObj.(*types.TypeName), iface)))
+	}
+	return diags
+}
+
+// importEdge is an import of the package given by to by the package given by from.
+type importEdge struct {
+	from, to string
+}
+
+// recordImport records in imports that rewriting the file given by fp to refer to impl makes its package
+// import the package of impl, unless it does already, together with the cause of the rewrite.
+func (p *program) recordImport(imports map[importEdge]string, fp string, impl *ifImplementation, cause string) {
+	pkg, _ := p.fileOf(fp)
+	implObj, err := p.objectAt(impl.filepath, impl.row, impl.col)
+	if pkg == nil || err != nil || pkg.PkgPath == implObj.Pkg().Path() {
+		return
+	}
+	if _, ok := pkg.Imports[implObj.Pkg().Path()]; ok {
+		return
+	}
+	edge := importEdge{from: pkg.PkgPath, to: implObj.Pkg().Path()}
+	if _, ok := imports[edge]; !ok {
+		imports[edge] = cause
+	}
+}
+
+// checkImportCycles returns a diagnostic for each import in imports that would create an import cycle
+// together with the existing imports of the project and the other imports added by the rewrite.
+func (p *program) checkImportCycles(imports map[importEdge]string) []string {
+	// the packages outside the project cannot import those of the project, so their imports are left out
+	graph := make(map[string][]string)
+	for _, pkg := range p.pkgs {
+		for path := range pkg.Imports {
+			graph[pkg.PkgPath] = append(graph[pkg.PkgPath], path)
+		}
+	}
+	edges := make([]importEdge, 0, len(imports))
+	for edge := range imports {
+		edges = append(edges, edge)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return imports[edges[i]] < imports[edges[j]]
+	})
+	for _, edge := range edges {
+		graph[edge.from] = append(graph[edge.from], edge.to)
+	}
+	var diags []string
+	for _, edge := range edges {
+		chain := importChain(graph, edge.to, edge.from)
+		if chain == nil {
+			continue
+		}
+		diags = append(diags, fmt.Sprintf("%s makes package %s import %s, which creates the import cycle %s",
+			imports[edge], edge.from, edge.to, strings.Join(append([]string{edge.from}, chain...), " -> ")))
+	}
+	return diags
+}
+
+// importChain returns the shortest chain of imports in graph leading from the package given by from to
+// the package given by to, both included, or nil if there is none.
+func importChain(graph map[string][]string, from, to string) []string {
+	prev := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		if path == to {
+			var chain []string
+			for ; path != ""; path = prev[path] {
+				chain = append([]string{path}, chain...)
+			}
+			return chain
+		}
+		imported := append([]string(nil), graph[path]...)
+		sort.Strings(imported)
+		for _, next := range imported {
+			if _, seen := prev[next]; !seen {
+				prev[next] = path
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
+
+// ptrRecvReason returns the reason why only a pointer to impl implements iface, to be appended to a
+// diagnostic, or an empty string if there is no method with a pointer receiver to blame.
+func ptrRecvReason(impl *types.TypeName, iface *types.Interface) string {
+	if m := ptrRecvMethod(impl, iface); m != "" {
+		return fmt.Sprintf(" since its method %s has a pointer receiver", m)
+	}
+	return ""
+}
+
+// ptrRecvMethod returns the name of the first method of impl implementing iface that has a pointer receiver.
+// If there is none an empty string is returned.
+func ptrRecvMethod(impl *types.TypeName, iface *types.Interface) string {
+	mset := types.NewMethodSet(types.NewPointer(impl.Type()))
+	for i := 0; i < iface.NumMethods(); i++ {
+		sel := mset.Lookup(iface.Method(i).Pkg(), iface.Method(i).Name())
+		if sel == nil {
+			continue
+		}
+		if _, ok := sel.Obj().(*types.Func).Type().(*types.Signature).Recv().Type().(*types.Pointer); ok {
+			return iface.Method(i).Name()
+		}
+	}
+	return ""
+}
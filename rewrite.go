@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/types"
+	"io"
+	"sort"
+)
+
+// rewriter holds the state shared while rewriting the tagged interfaces of a project.
+type rewriter struct {
+	ctx                 context.Context
+	cfg                 *config
+	rootFolder          string
+	ov                  *overlay
+	jr                  *journal
+	srcFilesToBackup    srcFilesToBackup
+	processedInterfaces []taggedInterface
+	// rewrittenBy holds the tagged interfaces whose rewrite touched each source file
+	rewrittenBy map[string][]*taggedInterface
+	// renamedBy holds the tagged interfaces whose rewrite gave each implementation its prefixed name
+	renamedBy map[string][]*taggedInterface
+	// excluded holds the keys of the tagged interfaces to leave as interfaces
+	excluded map[string]bool
+}
+
+// taggedReference is an interface reference together with the parsed content of its noifgo tag.
+type taggedReference struct {
+	reference
+	convertTo string
+	implName  string
+	// impl is the implementation chosen by implName
+	impl *ifImplementation
+}
+
+// rewriteForBuild rewrites every tagged interface in the project and adds the //line directives to the
+// rewritten source files. It returns an annotator writing the output of the go tool run in the folder
+// given by dir to w.
+func (r *rewriter) rewriteForBuild(w io.Writer, dir string) (*annotator, error) {
+	if err := r.rewriteAll(); err != nil {
+		return nil, err
+	}
+	if err := r.addLineDirectives(); err != nil {
+		return nil, err
+	}
+	return r.newAnnotator(w, dir), nil
+}
+
+// rewriteInOverlay rewrites every tagged interface in the project into a new overlay, leaving the source
+// files untouched, as done by rewriteForBuild. The caller removes the overlay with r.ov.remove().
+func rewriteInOverlay(ctx context.Context, cfg *config, rootFolder, dir string) (*rewriter, *annotator, error) {
+	ov, err := newOverlay()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create overlay: %s", err)
+	}
+	r := &rewriter{ctx: ctx, cfg: cfg, rootFolder: rootFolder, ov: ov}
+	ann, err := r.rewriteForBuild(nil, dir)
+	if err != nil {
+		ov.remove()
+		return nil, nil, err
+	}
+	return r, ann, nil
+}
+
+// rewriteAll checks and then rewrites every tagged interface in the project.
+func (r *rewriter) rewriteAll() error {
+	if err := r.preflight(); err != nil {
+		return err
+	}
+	for {
+		if debug {
+			fmt.Printf("Finds next tagged interface to process...\n")
+		}
+		if r.ctx.Err() != nil {
+			return errors.New("Interrupted")
+		}
+		taggedIf := nextInterfaceToProcess(r.ov, r.cfg, r.rootFolder, &r.processedInterfaces, ifdefTag)
+		// if no more interfaces to process
+		if taggedIf == nil {
+			return nil
+		}
+		if debug {
+			fmt.Printf("taggedIf: %v\n", taggedIf)
+		}
+		if r.excluded[taggedIf.key()] {
+			continue
+		}
+		if err := r.rewriteInterface(taggedIf); err != nil {
+			return err
+		}
+	}
+}
+
+// rewriteInterface replaces the tagged references of taggedIf with their chosen implementations.
+func (r *rewriter) rewriteInterface(taggedIf *taggedInterface) error {
+	if taggedIf.guard {
+		return r.guardInterface(taggedIf)
+	}
+	r.touch(taggedIf.filepath, taggedIf)
+
+	// - Loads and type checks the project in its current state -----------------------------
+	prog, err := loadProgram(r.ctx, r.cfg, r.rootFolder, r.ov)
+	if err != nil {
+		return fmt.Errorf("could not load project packages: %s", err)
+	}
+
+	// - Finds tagged interface references and parses their tags ----------------------------
+	ifRefs, err := prog.ifRefs(taggedIf.filepath, taggedIf.row, taggedIf.col)
+	if err != nil {
+		return fmt.Errorf("could not get interface references by interface: %s", err)
+	}
+	taggedRefs := make([]taggedReference, len(ifRefs))
+	for i, ifRef := range ifRefs {
+		if debug {
+			fmt.Printf("ifRef: %v\n", ifRef)
+		}
+		convertTo, implName, err := shouldConvertTo(r.ov, ifRef.filepath, ifRef.row, taggedIf.name)
+		if err != nil {
+			return fmt.Errorf("could not parse noifgo tag in %s on row %d: %s", ifRef.filepath, ifRef.row-1, err)
+		}
+		if implName == "" {
+			implName = taggedIf.impl
+		}
+		if convertTo == "" {
+			convertTo = r.cfg.Default
+		}
+		taggedRefs[i] = taggedReference{reference: ifRef, convertTo: convertTo, implName: implName}
+		r.touch(ifRef.filepath, taggedIf)
+	}
+
+	// - Finds the implementations chosen by the references and their references ------------
+	// Different impl names, e.g. sq and lib.sq or none at all, may choose the same implementation, so
+	// the implementations are told apart by their declaration
+	var impls []*ifImplementation
+	byName := make(map[string]*ifImplementation)
+	byDecl := make(map[ifImplementation]*ifImplementation)
+	for i, taggedRef := range taggedRefs {
+		if impl, ok := byName[taggedRef.implName]; ok {
+			taggedRefs[i].impl = impl
+			continue
+		}
+		impl, err := prog.implByIf(taggedIf.filepath, taggedIf.row, taggedIf.col, taggedRef.implName)
+		if err != nil {
+			return fmt.Errorf("could not get implementation by interface: %s", err)
+		}
+		if debug {
+			fmt.Printf("impl: %v\n", impl)
+		}
+		if known, ok := byDecl[*impl]; ok {
+			byName[taggedRef.implName] = known
+			taggedRefs[i].impl = known
+			continue
+		}
+		byName[taggedRef.implName] = impl
+		byDecl[*impl] = impl
+		taggedRefs[i].impl = impl
+		impls = append(impls, impl)
+		r.touch(impl.filepath, taggedIf)
+		implRefs, err := prog.implRefs(impl.filepath, impl.row, impl.col)
+		if err != nil {
+			return fmt.Errorf("could not get implementation references by interface: %s", err)
+		}
+		for _, implRef := range implRefs {
+			if debug {
+				fmt.Printf("implRef: %v\n", implRef)
+			}
+			r.touch(implRef.filepath, taggedIf)
+		}
+	}
+
+	// - Derives pointer or value for the references not choosing explicitly -------------------
+	for i, taggedRef := range taggedRefs {
+		if taggedRef.convertTo != "auto" {
+			continue
+		}
+		if taggedRefs[i].convertTo, err = prog.autoConvertTo(taggedIf, taggedRef.impl); err != nil {
+			return fmt.Errorf("%s:%d: %s", taggedRef.filepath, taggedRef.row, err)
+		}
+	}
+
+	if err = r.backup(); err != nil {
+		return err
+	}
+
+	// Adds a prefix to each interface implementation that also exports it. The project is reloaded
+	// after each rename since renaming shifts the positions of the identifiers following it.
+	sort.Slice(impls, func(i, j int) bool {
+		if impls[i].name != impls[j].name {
+			return impls[i].name < impls[j].name
+		}
+		return impls[i].filepath < impls[j].filepath
+	})
+	for _, impl := range impls {
+		if err = prog.renameRefMany(r.ov, impl.filepath, impl.row, impl.col, r.cfg.ImplPrefix+impl.name); err != nil {
+			return fmt.Errorf("could not rename implementation %s in file %s: %s", impl.name, impl.filepath, err)
+		}
+		r.renamed(r.cfg.ImplPrefix+impl.name, taggedIf)
+		if prog, err = loadProgram(r.ctx, r.cfg, r.rootFolder, r.ov); err != nil {
+			return fmt.Errorf("could not load project packages: %s", err)
+		}
+	}
+	if ifRefs, err = prog.ifRefs(taggedIf.filepath, taggedIf.row, taggedIf.col); err != nil {
+		return fmt.Errorf("could not get interface references by interface: %s", err)
+	}
+	if len(ifRefs) != len(taggedRefs) {
+		return fmt.Errorf("references to interface %s changed while renaming its implementations", taggedIf.name)
+	}
+
+	// Renames interface references to the implementation, starting with the last reference so that
+	// renaming a reference does not shift the ones still to be renamed
+	addImports := make(map[string]map[string]string)
+	for i := len(ifRefs) - 1; i >= 0; i-- {
+		ifRef := ifRefs[i]
+		impl := taggedRefs[i].impl
+		start, end, err := prog.refSpan(ifRef)
+		if err != nil {
+			return fmt.Errorf("could not get reference span for %s on row %d and column %d: %s", ifRef.filepath, ifRef.row, ifRef.col, err)
+		}
+		var typePrefix string
+		if taggedRefs[i].convertTo == "p" {
+			typePrefix = "*"
+		} else {
+			typePrefix = ""
+		}
+		pkgPrefix, err := r.pkgPrefix(prog, ifRef.filepath, impl, addImports)
+		if err != nil {
+			return err
+		}
+		to := typePrefix + pkgPrefix + r.cfg.ImplPrefix + impl.name
+		if typePrefix != "" && prog.isConversion(ifRef) {
+			to = "(" + to + ")"
+		}
+		if err = renameRefSingle(r.ov, ifRef.filepath, to, start, end); err != nil {
+			return fmt.Errorf("could not rename reference in %s on row %d: %s", ifRef.filepath, ifRef.row, err)
+		}
+	}
+	for _, ifRef := range ifRefs {
+		// Run GoImports on all files where the interface references were renamed to the implementation
+		if err = fixImports(r.ov, ifRef.filepath, addImports[ifRef.filepath]); err != nil {
+			return err
+		}
+		delete(addImports, ifRef.filepath)
+	}
+	return nil
+}
+
+// guardInterface keeps taggedIf and its references but rewrites the method calls on its values into
+// guarded calls, which call the chosen implementation directly whenever the value holds it.
+func (r *rewriter) guardInterface(taggedIf *taggedInterface) error {
+	r.touch(taggedIf.filepath, taggedIf)
+
+	// - Loads and type checks the project in its current state -----------------------------
+	prog, err := loadProgram(r.ctx, r.cfg, r.rootFolder, r.ov)
+	if err != nil {
+		return fmt.Errorf("could not load project packages: %s", err)
+	}
+
+	// - Finds the implementation, its references and the calls to guard -----------------------
+	tn, iface, err := prog.interfaceAt(taggedIf.filepath, taggedIf.row, taggedIf.col)
+	if err != nil {
+		return err
+	}
+	impl, err := prog.implByIf(taggedIf.filepath, taggedIf.row, taggedIf.col, taggedIf.impl)
+	if err != nil {
+		return fmt.Errorf("could not get implementation by interface: %s", err)
+	}
+	implObj, err := prog.objectAt(impl.filepath, impl.row, impl.col)
+	if err != nil {
+		return err
+	}
+	convertTo := taggedIf.guardAs
+	if convertTo == "" {
+		convertTo = guardAs(implObj.(*types.TypeName), iface)
+	}
+	r.touch(impl.filepath, taggedIf)
+	implRefs, err := prog.implRefs(impl.filepath, impl.row, impl.col)
+	if err != nil {
+		return fmt.Errorf("could not get implementation references by interface: %s", err)
+	}
+	for _, implRef := range implRefs {
+		r.touch(implRef.filepath, taggedIf)
+	}
+	calls := prog.guardedCalls(tn)
+	if len(calls) == 0 {
+		return nil
+	}
+	for _, c := range calls {
+		r.touch(c.filepath, taggedIf)
+	}
+
+	if err = r.backup(); err != nil {
+		return err
+	}
+
+	// Adds a prefix to the interface implementation that also exports it
+	if err = prog.renameRefMany(r.ov, impl.filepath, impl.row, impl.col, r.cfg.ImplPrefix+impl.name); err != nil {
+		return fmt.Errorf("could not rename implementation %s in file %s: %s", impl.name, impl.filepath, err)
+	}
+	r.renamed(r.cfg.ImplPrefix+impl.name, taggedIf)
+	if prog, err = loadProgram(r.ctx, r.cfg, r.rootFolder, r.ov); err != nil {
+		return fmt.Errorf("could not load project packages: %s", err)
+	}
+	if tn, _, err = prog.interfaceAt(taggedIf.filepath, taggedIf.row, taggedIf.col); err != nil {
+		return err
+	}
+
+	// Guards the calls file by file
+	calls = prog.guardedCalls(tn)
+	addImports := make(map[string]map[string]string)
+	for i := 0; i < len(calls); {
+		j := i
+		for j < len(calls) && calls[j].filepath == calls[i].filepath {
+			j++
+		}
+		fp := calls[i].filepath
+		var typePrefix string
+		if convertTo == "p" {
+			typePrefix = "*"
+		}
+		pkgPrefix, err := r.pkgPrefix(prog, fp, impl, addImports)
+		if err != nil {
+			return err
+		}
+		if err = prog.guardCalls(r.ov, fp, calls[i:j], typePrefix+pkgPrefix+r.cfg.ImplPrefix+impl.name); err != nil {
+			return fmt.Errorf("could not guard calls in %s: %s", fp, err)
+		}
+		// Run GoImports on all files with guarded calls
+		if err = fixImports(r.ov, fp, addImports[fp]); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// pkgPrefix returns the package qualifier, including the trailing dot, the file given by fp refers to the
+// package of impl by. If the file does not import the package yet, the import is recorded in addImports
+// keyed by filepath and import path, mapped to its name unless the import path implies the name.
+func (r *rewriter) pkgPrefix(prog *program, fp string, impl *ifImplementation, addImports map[string]map[string]string) (string, error) {
+	implObj, err := prog.objectAt(impl.filepath, impl.row, impl.col)
+	if err != nil {
+		return "", err
+	}
+	implPkg := implObj.Pkg()
+	if addImports[fp] == nil {
+		addImports[fp] = make(map[string]string)
+	}
+	name, addImport, err := prog.qualifier(fp, implPkg, addImports[fp])
+	if err != nil {
+		return "", fmt.Errorf("could not qualify %s in %s: %s", impl.name, fp, err)
+	}
+	if addImport {
+		addImports[fp][implPkg.Path()] = name
+	}
+	if name == "" {
+		return "", nil
+	}
+	return name + ".", nil
+}
+
+// autoConvertTo derives whether a reference to taggedIf is replaced by a pointer or a value of impl from
+// the receivers of impl's methods. If a method implementing taggedIf has a pointer receiver only a pointer
+// implements the interface and "p" is returned. Otherwise both would work and an error asking for an
+// explicit choice is returned.
+func (p *program) autoConvertTo(taggedIf *taggedInterface, impl *ifImplementation) (string, error) {
+	_, iface, err := p.interfaceAt(taggedIf.filepath, taggedIf.row, taggedIf.col)
+	if err != nil {
+		return "", err
+	}
+	implObj, err := p.objectAt(impl.filepath, impl.row, impl.col)
+	if err != nil {
+		return "", err
+	}
+	if types.Implements(implObj.Type(), iface) {
+		return "", fmt.Errorf("both a pointer and a value of %s implement %s, choose one with //noifgo:{%s,p} or //noifgo:{%s,v}",
+			impl.name, taggedIf.name, taggedIf.name, taggedIf.name)
+	}
+	return "p", nil
+}
+
+// touch records that the source file given by fp is rewritten for taggedIf and has to be backed up.
+func (r *rewriter) touch(fp string, taggedIf *taggedInterface) {
+	r.srcFilesToBackup.Add(fp)
+	if r.rewrittenBy == nil {
+		r.rewrittenBy = make(map[string][]*taggedInterface)
+	}
+	r.rewrittenBy[fp] = appendOnce(r.rewrittenBy[fp], taggedIf)
+}
+
+// renamed records that the rewrite for taggedIf renamed an implementation to the name given by to.
+func (r *rewriter) renamed(to string, taggedIf *taggedInterface) {
+	if r.renamedBy == nil {
+		r.renamedBy = make(map[string][]*taggedInterface)
+	}
+	r.renamedBy[to] = appendOnce(r.renamedBy[to], taggedIf)
+}
+
+// appendOnce appends taggedIf to ifs unless ifs holds it already.
+func appendOnce(ifs []*taggedInterface, taggedIf *taggedInterface) []*taggedInterface {
+	for _, t := range ifs {
+		if t == taggedIf {
+			return ifs
+		}
+	}
+	return append(ifs, taggedIf)
+}
+
+// backup creates a backup for each source file to backup unless the source files are left untouched.
+func (r *rewriter) backup() error {
+	for i := 0; r.ov == nil && i < len(r.srcFilesToBackup); i++ {
+		if r.srcFilesToBackup[i].backedUp {
+			continue
+		}
+		if err := r.jr.backup(r.srcFilesToBackup[i].filepath); err != nil {
+			return fmt.Errorf("could not back up file %s: %s", r.srcFilesToBackup[i].filepath, err)
+		}
+		r.srcFilesToBackup[i].backedUp = true
+	}
+	return nil
+}
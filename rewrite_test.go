@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeProject writes files, keyed by their filepath relative to the root folder, into a new module in a
+// temporary folder and returns the root folder.
+func writeProject(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	files["go.mod"] = "module example.com/p\n\ngo 1.21\n"
+	for rel, content := range files {
+		fp := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(fp), os.FileMode(0755)); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fp, []byte(content), os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestRewriteInPlaceJournalsEmbeddedFieldUses(t *testing.T) {
+	use := "package lib\n\nfunc Use(w Wrapper) string { return w.impl.Sing() }\n"
+	root := writeProject(t, map[string]string{
+		"lib/lib.go": "package lib\n\n//noifgo:ifdef impl=impl\ntype Singer interface{ Sing() string }\n\n" +
+			"type impl struct{}\n\nfunc (*impl) Sing() string { return \"la\" }\n\n" +
+			"func New() Singer { return &impl{} }\n\ntype Wrapper struct{ *impl }\n",
+		"lib/use.go": use,
+	})
+	cfg, err := readConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr, err := newJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &rewriter{ctx: context.Background(), cfg: cfg, rootFolder: root, jr: jr}
+	if err = r.rewriteAll(); err != nil {
+		t.Fatalf("rewriteAll() error = %v", err)
+	}
+	useFp := filepath.Join(root, "lib", "use.go")
+	b, err := ioutil.ReadFile(useFp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "w.NoIFGoimpl.Sing()") {
+		t.Fatalf("use.go was not rewritten:\n%s", b)
+	}
+
+	// the run is restored from the journal read back from disk, as by noifgo restore
+	if jr, err = readJournal(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = jr.restore(); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if b, err = ioutil.ReadFile(useFp); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != use {
+		t.Errorf("use.go after restore =\n%s\nwant\n%s", b, use)
+	}
+}
+
+func TestRewriteImplChosenByDifferentNames(t *testing.T) {
+	root := writeProject(t, map[string]string{
+		"lib/lib.go": "package lib\n\n//noifgo:ifdef\ntype Shape interface{ Area() int }\n\n" +
+			"type sq struct{}\n\nfunc (*sq) Area() int { return 1 }\n\n" +
+			"//noifgo:{Shape,p,impl=sq}\nfunc New() Shape { return &sq{} }\n\n" +
+			"func Old() Shape { return &sq{} }\n\n" +
+			"//noifgo:{Shape,p,impl=lib.sq}\nvar Global Shape = &sq{}\n",
+	})
+	cfg, err := readConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := rewriteInOverlay(context.Background(), cfg, root, root)
+	if err != nil {
+		t.Fatalf("rewriteInOverlay() error = %v", err)
+	}
+	defer r.ov.remove()
+	b, err := r.ov.readFile(filepath.Join(root, "lib", "lib.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"type NoIFGosq struct{}", "func New() *NoIFGosq", "func Old() *NoIFGosq", "var Global *NoIFGosq"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("rewritten lib.go does not contain %q:\n%s", want, b)
+		}
+	}
+}
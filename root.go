@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hiddenFilename is the name of the file marking a project's root folder.
+const hiddenFilename = ".noifgo"
+
+// findRoot returns the project root folder for the working directory wd. It is the closest folder
+// holding the hidden file .noifgo, starting with wd and moving up. Without one it falls back to the
+// folder of the go.work file of the workspace wd belongs to, and then to the folder of the go.mod
+// file of the module wd belongs to. If neither is found an empty string is returned.
+func findRoot(wd string) (string, error) {
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, hiddenFilename)); err == nil {
+			return dir, nil
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	cmd := exec.Command("go", "env", "GOWORK", "GOMOD")
+	cmd.Dir = wd
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("could not run go env: %s", err)
+	}
+	for _, line := range strings.Split(string(bytes.TrimSpace(out)), "\n") {
+		// GOWORK is "off" when workspaces are disabled and GOMOD is the null device outside a module
+		line = strings.TrimSpace(line)
+		if line == "" || line == "off" || line == os.DevNull {
+			continue
+		}
+		return filepath.Dir(line), nil
+	}
+	return "", nil
+}
+
+// loadPatterns returns the package patterns to load the project in rootFolder by. A workspace
+// spanning several modules is loaded by one pattern per module found in rootFolder, since a
+// single ./... pattern does not cross module boundaries. If the modules can not be listed
+// the packages in rootFolder and its sub folders are loaded.
+func loadPatterns(ctx context.Context, cfg *config, rootFolder string) []string {
+	cmd := exec.CommandContext(ctx, cfg.goBinary(), "list", "-m", "-f", "{{.Dir}}")
+	cmd.Dir = rootFolder
+	cmd.Env = cfg.env()
+	out, err := cmd.Output()
+	if err != nil {
+		return []string{"./..."}
+	}
+	var patterns []string
+	seen := make(map[string]bool)
+	for _, dir := range strings.Split(string(bytes.TrimSpace(out)), "\n") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		var pattern string
+		if within(rootFolder, dir) {
+			// the root folder is part of the module
+			pattern = "./..."
+		} else if within(dir, rootFolder) {
+			rel, _ := filepath.Rel(rootFolder, dir)
+			pattern = "./" + filepath.ToSlash(rel) + "/..."
+		} else {
+			// modules outside the root folder are not part of the project
+			continue
+		}
+		if !seen[pattern] {
+			seen[pattern] = true
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return []string{"./..."}
+	}
+	return patterns
+}
+
+// within reports whether the path given by fp is the folder given by dir or inside it.
+func within(fp, dir string) bool {
+	rel, err := filepath.Rel(dir, fp)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
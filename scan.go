@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const helpScan = `Usage:
+
+	noifgo scan [-apply]
+
+Scan lists every interface in the project with exactly one implementation, test files excluded,
+together with the implementation, the receiver kind of its methods and the number of references
+to the interface.
+
+The flags are:
+
+	-apply
+		insert the noifgo tags for every listed interface and its references into
+		the source files.
+
+`
+
+// singleImplInterface is an interface of the project with exactly one implementation.
+type singleImplInterface struct {
+	tn   *types.TypeName
+	impl *types.TypeName
+	// recvKind is "pointer", "value" or "mixed" depending on the receivers of the implementation's
+	// methods implementing the interface
+	recvKind string
+	refs     []token.Position
+}
+
+// scan implements the "noifgo scan" command.
+func scan(ctx context.Context, cfg *config, rootFolder string, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Printf(helpScan)
+	}
+	apply := fs.Bool("apply", false, "Insert the noifgo tags into the source files.")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	prog, err := loadProgram(ctx, cfg, rootFolder, nil)
+	if err != nil {
+		return fmt.Errorf("could not load project packages: %s", err)
+	}
+	ifs := prog.singleImplInterfaces()
+	if len(ifs) == 0 {
+		fmt.Printf("No interfaces with a single implementation found\n")
+		return nil
+	}
+	for _, si := range ifs {
+		pos := prog.fset.Position(si.tn.Pos())
+		rel, err := filepath.Rel(rootFolder, pos.Filename)
+		if err != nil {
+			rel = pos.Filename
+		}
+		var tagged string
+		if hasTag(pos.Filename, pos.Line, ifdefTag) {
+			tagged = "  [tagged]"
+		}
+		fmt.Printf("%s:%d: %s  implemented by %s.%s (%s receivers)  %d references%s\n", rel, pos.Line, si.tn.Name(),
+			si.impl.Pkg().Name(), si.impl.Name(), si.recvKind, len(si.refs), tagged)
+	}
+	if !*apply {
+		return nil
+	}
+	return prog.applyTags(ifs)
+}
+
+// singleImplInterfaces returns every package level interface declared outside test files in the
+// project that has exactly one implementation, sorted by position. The references of each interface
+// include those in test files, which are rewritten as well.
+func (p *program) singleImplInterfaces() []singleImplInterface {
+	var ifs []singleImplInterface
+	for _, pkg := range p.pkgs {
+		if isTestVariant(pkg) {
+			continue
+		}
+		scope := pkg.Types.Scope()
+		for _, name := range scope.Names() {
+			tn, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok || tn.IsAlias() {
+				continue
+			}
+			named, ok := tn.Type().(*types.Named)
+			if !ok || named.TypeParams().Len() > 0 {
+				continue
+			}
+			iface, ok := named.Underlying().(*types.Interface)
+			if !ok || iface.NumMethods() == 0 {
+				continue
+			}
+			if strings.HasSuffix(p.fset.Position(tn.Pos()).Filename, "_test.go") {
+				continue
+			}
+			impls := p.implementations(iface)
+			if len(impls) != 1 {
+				continue
+			}
+			si := singleImplInterface{tn: tn, impl: impls[0], recvKind: recvKind(impls[0], iface), refs: p.uses(tn)}
+			ifs = append(ifs, si)
+		}
+	}
+	sort.Slice(ifs, func(i, j int) bool {
+		a, b := p.fset.Position(ifs[i].tn.Pos()), p.fset.Position(ifs[j].tn.Pos())
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+	return ifs
+}
+
+// recvKind returns "pointer" if every method of the implementation given by impl implementing iface
+// has a pointer receiver, "value" if every such method has a value receiver and "mixed" otherwise.
+func recvKind(impl *types.TypeName, iface *types.Interface) string {
+	ptrRecvs, valueRecvs := 0, 0
+	mset := types.NewMethodSet(types.NewPointer(impl.Type()))
+	for i := 0; i < iface.NumMethods(); i++ {
+		sel := mset.Lookup(iface.Method(i).Pkg(), iface.Method(i).Name())
+		if sel == nil {
+			continue
+		}
+		recv := sel.Obj().(*types.Func).Type().(*types.Signature).Recv()
+		if _, ok := recv.Type().(*types.Pointer); ok {
+			ptrRecvs++
+		} else {
+			valueRecvs++
+		}
+	}
+	switch {
+	case valueRecvs == 0:
+		return "pointer"
+	case ptrRecvs == 0:
+		return "value"
+	}
+	return "mixed"
+}
+
+// applyTags inserts the noifgo tags for each interface in ifs and their references into the source
+// files. A reference is tagged only if the configured default would not replace it as wanted: it is
+// tagged to be replaced by a value if both a pointer and a value implement the interface, unless values
+// are the default, and by a pointer if only a pointer does while values are the default.
+func (p *program) applyTags(ifs []singleImplInterface) error {
+	// tags to insert keyed by filepath and the row the tag belongs to
+	ifdefs := make(map[string]map[int]bool)
+	refTags := make(map[string]map[int][]string)
+	for _, si := range ifs {
+		pos := p.fset.Position(si.tn.Pos())
+		if !hasTag(pos.Filename, pos.Line, ifdefTag) {
+			if ifdefs[pos.Filename] == nil {
+				ifdefs[pos.Filename] = make(map[int]bool)
+			}
+			ifdefs[pos.Filename][pos.Line] = true
+		}
+		var convertTo string
+		switch {
+		case si.recvKind == "value" && p.cfg.Default != "v":
+			convertTo = "v"
+		case si.recvKind != "value" && p.cfg.Default == "v":
+			convertTo = "p"
+		default:
+			continue
+		}
+		for _, ref := range si.refs {
+			if convertTo, _, err := shouldConvertTo(nil, ref.Filename, ref.Line, si.tn.Name()); err != nil || convertTo != "" {
+				continue
+			}
+			if refTags[ref.Filename] == nil {
+				refTags[ref.Filename] = make(map[int][]string)
+			}
+			pair := si.tn.Name() + "," + convertTo
+			if rowTags := refTags[ref.Filename][ref.Line]; len(rowTags) == 0 || rowTags[len(rowTags)-1] != pair {
+				refTags[ref.Filename][ref.Line] = append(rowTags, pair)
+			}
+		}
+	}
+	fps := make(map[string]bool)
+	for fp := range ifdefs {
+		fps[fp] = true
+	}
+	for fp := range refTags {
+		fps[fp] = true
+	}
+	for fp := range fps {
+		if err := insertTags(fp, ifdefs[fp], refTags[fp]); err != nil {
+			return fmt.Errorf("could not insert tags into %s: %s", fp, err)
+		}
+	}
+	fmt.Printf("Tagged %d interfaces in %d files\n", len(ifs), len(fps))
+	return nil
+}
+
+// insertTags inserts a noifgo:ifdef tag above each row in ifdefs and a reference tag holding the
+// interface and p/v pairs above each row in refTags, into the file given by fp. A reference tag is
+// merged into an existing reference tag on the row above.
+func insertTags(fp string, ifdefs map[int]bool, refTags map[int][]string) error {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(b, []byte("\n"))
+	var out [][]byte
+	for i, line := range lines {
+		row := i + 1
+		indent := []byte(leadingSpace(line))
+		pairs := refTags[row]
+		if len(pairs) > 0 && len(out) > 0 && bytes.Contains(out[len(out)-1], []byte("noifgo:{")) {
+			prev := out[len(out)-1]
+			closingCurlyBrIx := bytes.LastIndex(prev, []byte("}"))
+			if closingCurlyBrIx == -1 {
+				return fmt.Errorf("noifgo tag on row %d malformed: could not find closing '}'", row-1)
+			}
+			merged := append([]byte{}, prev[:closingCurlyBrIx]...)
+			merged = append(merged, "; "+strings.Join(pairs, "; ")...)
+			out[len(out)-1] = append(merged, prev[closingCurlyBrIx:]...)
+			pairs = nil
+		}
+		if len(pairs) > 0 {
+			// a noifgo:ifdef tag must be on the row right above the interface definition
+			if ifdefs[row] || (len(out) > 0 && bytes.Contains(out[len(out)-1], ifdefTag)) {
+				fmt.Fprintf(os.Stderr, "%s:%d: skipping reference tag since the row above holds a noifgo:ifdef tag\n", fp, row)
+			} else {
+				out = append(out, append(indent, "//noifgo:{"+strings.Join(pairs, "; ")+"}"...))
+			}
+		}
+		if ifdefs[row] {
+			if bytes.HasPrefix(line, []byte("type ")) {
+				out = append(out, []byte("//noifgo:ifdef"))
+			} else {
+				fmt.Fprintf(os.Stderr, "%s:%d: skipping noifgo:ifdef tag since only interfaces declared on their own with 'type' are processed\n", fp, row)
+			}
+		}
+		out = append(out, line)
+	}
+	info, err := os.Stat(fp)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fp, bytes.Join(out, []byte("\n")), info.Mode())
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const helpSize = `Usage:
+
+	noifgo size [build flags] [package]
+
+Size builds the main package twice, first from the untouched source files and then from the source
+files with every tagged interface rewritten the same way a build does, and compares the two binaries.
+It prints the size of each binary and of each of its loaded sections, e.g. .text and .data, followed
+by the itabs, i.e. the tables pairing a concrete type with an interface, and the methods of the
+project's packages linked into only one of the binaries.
+
+The arguments are passed to both runs of "go build", e.g. noifgo size -trimpath ./cmd/foo. Only ELF
+binaries, as built for Linux and most other Unix systems, can be compared. The source files are left
+untouched.
+
+`
+
+// itabPattern matches the name of an itab symbol, e.g. go:itab.*example.com/lib.impl,example.com/lib.If.
+var itabPattern = regexp.MustCompile(`go[:.]itab\.[^\s]+`)
+
+// methodPattern matches the last element of the name of a method symbol, e.g. lib.(*impl).M or lib.impl.M,
+// whose method name is not that of a closure.
+var methodPattern = regexp.MustCompile(`^\w+\.(\(\*\w+\)|\w+)\.\w+$`)
+
+// closurePattern matches the names the compiler gives to closures and wrappers, e.g. func1.
+var closurePattern = regexp.MustCompile(`^(func|gowrap|deferwrap)\d+$`)
+
+// binaryInfo holds what the size command compares of a binary.
+type binaryInfo struct {
+	size int64
+	// sections holds the names of the loaded sections in the order of the binary
+	sections     []string
+	sectionSizes map[string]uint64
+	itabs        map[string]bool
+	methods      map[string]bool
+}
+
+// size implements the "noifgo size" command.
+func size(ctx context.Context, cfg *config, rootFolder string, args []string) error {
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		fmt.Printf(helpSize)
+		return nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	outDir, err := ioutil.TempDir("", "noifgo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outDir)
+	modules, err := modulePaths(ctx, cfg, rootFolder)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Building the original code\n")
+	before, err := buildBinary(ctx, cfg, wd, nil, nil, filepath.Join(outDir, "original"), args, modules)
+	if err != nil {
+		return err
+	}
+	r, ann, err := rewriteInOverlay(ctx, cfg, rootFolder, wd)
+	if err != nil {
+		return err
+	}
+	defer r.ov.remove()
+	fmt.Fprintf(os.Stderr, "Building the rewritten code\n")
+	after, err := buildBinary(ctx, cfg, wd, r.ov, ann, filepath.Join(outDir, "rewritten"), args, modules)
+	if err != nil {
+		return err
+	}
+
+	// the names of the implementations are compared without their prefix
+	for _, info := range []*binaryInfo{before, after} {
+		for _, set := range []map[string]bool{info.itabs, info.methods} {
+			for name := range set {
+				delete(set, name)
+				set[cfg.stripImplPrefix(name)] = true
+			}
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "\toriginal\trewritten\tdelta\n")
+	fmt.Fprintf(w, "file\t%s\t%s\t%s\n", formatSize(uint64(before.size)), formatSize(uint64(after.size)), sizeDelta(uint64(before.size), uint64(after.size)))
+	sections := before.sections
+	for _, name := range after.sections {
+		if _, ok := before.sectionSizes[name]; !ok {
+			sections = append(sections, name)
+		}
+	}
+	for _, name := range sections {
+		b, a := before.sectionSizes[name], after.sectionSizes[name]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, formatSize(b), formatSize(a), sizeDelta(b, a))
+	}
+	w.Flush()
+	printSymbolChanges("Itabs", before.itabs, after.itabs)
+	printSymbolChanges("Methods of the project", before.methods, after.methods)
+	return nil
+}
+
+// buildBinary builds the main package given by args into the file given by outFp, from the source files
+// rewritten in ov if ov is not nil, and reads the resulting binary. The methods read are those of the
+// packages of the modules given by their paths. If the build fails its output is returned in the error,
+// translated by ann unless it is nil.
+func buildBinary(ctx context.Context, cfg *config, dir string, ov *overlay, ann *annotator, outFp string, args, modules []string) (*binaryInfo, error) {
+	buildArgs := []string{"build", "-o", outFp}
+	if ov != nil {
+		overlayFp, err := ov.writeJSON()
+		if err != nil {
+			return nil, fmt.Errorf("could not write overlay: %s", err)
+		}
+		buildArgs = append(buildArgs, "-overlay="+overlayFp)
+	}
+	cmd := exec.CommandContext(ctx, cfg.goBinary(), append(buildArgs, withDumpDep(args)...)...)
+	cmd.Dir = dir
+	cmd.Env = cfg.env()
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, errors.New("Interrupted")
+	}
+	if err != nil {
+		var failure strings.Builder
+		for _, line := range splitLines(out) {
+			if itabPattern.MatchString(line) || strings.Contains(line, " -> ") {
+				// the dependency graph dumped by the linker
+				continue
+			}
+			if ann != nil {
+				line = ann.annotate(line)
+			}
+			failure.WriteString(line)
+		}
+		return nil, fmt.Errorf("go build failed: %s\n%s", err, strings.TrimRight(failure.String(), "\n"))
+	}
+
+	info, err := readBinary(outFp, modules)
+	if err != nil {
+		return nil, err
+	}
+	// the linker leaves the itabs out of the symbol table, but lists them in its dependency graph
+	for _, itab := range itabPattern.FindAllString(string(out), -1) {
+		info.itabs[strings.Replace(itab, "go.itab.", "go:itab.", 1)] = true
+	}
+	return info, nil
+}
+
+// withDumpDep returns the build flags args with the linker flag -dumpdep added, which makes the linker
+// print the dependency graph of the symbols it links.
+func withDumpDep(args []string) []string {
+	args = append([]string{}, args...)
+	for i, arg := range args {
+		switch {
+		case (arg == "-ldflags" || arg == "--ldflags") && i+1 < len(args):
+			args[i+1] += " -dumpdep"
+			return args
+		case strings.HasPrefix(arg, "-ldflags=") || strings.HasPrefix(arg, "--ldflags="):
+			args[i] += " -dumpdep"
+			return args
+		}
+	}
+	return append([]string{"-ldflags=-dumpdep"}, args...)
+}
+
+// readBinary reads the size, the loaded sections, the itabs and the methods of the packages of modules
+// from the ELF binary given by fp.
+func readBinary(fp string, modules []string) (*binaryInfo, error) {
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return nil, err
+	}
+	f, err := elf.Open(fp)
+	if err != nil {
+		// go build writes an archive for a package which is not a main package
+		if b, readErr := ioutil.ReadFile(fp); readErr == nil && bytes.HasPrefix(b, []byte("!<arch>\n")) {
+			return nil, errors.New("the package built is not a main package")
+		}
+		return nil, fmt.Errorf("could not read binary %s, only ELF binaries are supported: %s", fp, err)
+	}
+	defer f.Close()
+	info := &binaryInfo{
+		size:         fi.Size(),
+		sectionSizes: make(map[string]uint64),
+		itabs:        make(map[string]bool),
+		methods:      make(map[string]bool),
+	}
+	for _, sec := range f.Sections {
+		if sec.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+		info.sections = append(info.sections, sec.Name)
+		info.sectionSizes[sec.Name] = sec.Size
+	}
+	symbols, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+	for _, sym := range symbols {
+		if itabPattern.MatchString(sym.Name) {
+			info.itabs[strings.Replace(sym.Name, "go.itab.", "go:itab.", 1)] = true
+			continue
+		}
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || !inModules(sym.Name, modules) {
+			continue
+		}
+		last := sym.Name[strings.LastIndex(sym.Name, "/")+1:]
+		if m := methodPattern.FindStringSubmatch(last); m != nil && !closurePattern.MatchString(last[strings.LastIndex(last, ".")+1:]) {
+			info.methods[sym.Name] = true
+		}
+	}
+	return info, nil
+}
+
+// inModules reports whether the symbol given by name belongs to a package of one of the modules given by
+// their paths.
+func inModules(name string, modules []string) bool {
+	for _, module := range modules {
+		if strings.HasPrefix(name, module+"/") || strings.HasPrefix(name, module+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// modulePaths returns the paths of the modules of the project in rootFolder.
+func modulePaths(ctx context.Context, cfg *config, rootFolder string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, cfg.goBinary(), "list", "-m", "-f", "{{.Path}}")
+	cmd.Dir = rootFolder
+	cmd.Env = cfg.env()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the modules of the project: %s", err)
+	}
+	var modules []string
+	for _, line := range strings.Split(string(bytes.TrimSpace(out)), "\n") {
+		if line = strings.TrimSpace(line); line != "" && line != "command-line-arguments" {
+			modules = append(modules, line)
+		}
+	}
+	return modules, nil
+}
+
+// formatSize formats the number of bytes n with three significant digits.
+func formatSize(n uint64) string {
+	return formatValue(float64(n), "B/op")
+}
+
+// sizeDelta formats the change of a size from before to after in bytes and in percent of before.
+func sizeDelta(before, after uint64) string {
+	delta := int64(after) - int64(before)
+	if delta == 0 {
+		return "~"
+	}
+	if before == 0 {
+		return fmt.Sprintf("%+d B", delta)
+	}
+	return fmt.Sprintf("%+d B (%+.2f%%)", delta, float64(delta)/float64(before)*100)
+}
+
+// printSymbolChanges prints the symbols, of the kind given by title, found in only one of before and
+// after.
+func printSymbolChanges(title string, before, after map[string]bool) {
+	for _, change := range []struct {
+		when          string
+		found, absent map[string]bool
+	}{{"before", before, after}, {"after", after, before}} {
+		var names []string
+		for name := range change.found {
+			if !change.absent[name] {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		fmt.Printf("\n%s linked only %s the rewrite:\n", title, change.when)
+		for _, name := range names {
+			fmt.Printf("\t%s\n", name)
+		}
+	}
+}
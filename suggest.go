@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"golang.org/x/tools/go/packages"
+)
+
+const helpSuggest = `Usage:
+
+	noifgo suggest -profile cpu.pprof [-n count]
+
+Suggest reads a pprof CPU profile and finds its hot dynamic dispatch call sites, i.e. method calls on
+interface values. The call sites are mapped to the interfaces defined in the project which are ranked
+by sample weight and number of implementations, together with the noifgo tags to add.
+
+`
+
+// fileLine identifies a line in a source file.
+type fileLine struct {
+	filepath string
+	row      int
+}
+
+// hotInterface is an interface of the project whose method calls were sampled in a profile.
+type hotInterface struct {
+	tn        *types.TypeName
+	iface     *types.Interface
+	weight    int64
+	callSites map[fileLine]bool
+	// implWeight holds the sample weight of the calls dispatched to each implementation
+	implWeight map[*types.TypeName]int64
+	impls      []*types.TypeName
+}
+
+// suggest implements the "noifgo suggest" command.
+func suggest(ctx context.Context, cfg *config, rootFolder string, args []string) error {
+	fs := flag.NewFlagSet("suggest", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Printf(helpSuggest)
+	}
+	profileFp := fs.String("profile", "", "pprof CPU profile to read.")
+	count := fs.Int("n", 10, "Number of interfaces to suggest.")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if *profileFp == "" {
+		fs.Usage()
+		return errors.New("missing -profile flag")
+	}
+	f, err := os.Open(*profileFp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	prof, err := profile.Parse(f)
+	if err != nil {
+		return fmt.Errorf("could not parse profile %s: %s", *profileFp, err)
+	}
+	valueIx, err := sampleIndex(prof)
+	if err != nil {
+		return fmt.Errorf("could not read profile %s: %s", *profileFp, err)
+	}
+	prog, err := loadProgram(ctx, cfg, rootFolder, nil)
+	if err != nil {
+		return fmt.Errorf("could not load project packages: %s", err)
+	}
+	hot, total := prog.hotInterfaces(prof, valueIx)
+	if len(hot) == 0 {
+		fmt.Printf("No dynamic dispatch call sites of project interfaces found in the profile\n")
+		return nil
+	}
+	if len(hot) > *count {
+		hot = hot[:*count]
+	}
+	valueType := prof.SampleType[valueIx]
+	for i, h := range hot {
+		fmt.Printf("%d. %s.%s  %.1f%% (%s)  %d call sites  %d implementations\n", i+1, h.tn.Pkg().Name(), h.tn.Name(),
+			100*float64(h.weight)/float64(total), formatWeight(h.weight, valueType), len(h.callSites), len(h.impls))
+		prog.printSuggestion(rootFolder, h)
+		fmt.Printf("\n")
+	}
+	return nil
+}
+
+// sampleIndex returns the index of the sample values of prof to weigh the samples by, those of its default
+// sample type if it has one and those of its last sample type otherwise, e.g. cpu of a CPU profile.
+func sampleIndex(prof *profile.Profile) (int, error) {
+	if len(prof.SampleType) == 0 {
+		return 0, errors.New("the profile has no sample types")
+	}
+	for i, st := range prof.SampleType {
+		if st.Type == prof.DefaultSampleType {
+			return i, nil
+		}
+	}
+	return len(prof.SampleType) - 1, nil
+}
+
+// hotInterfaces maps the sampled call sites of prof to method calls on interface values of the project,
+// weighing the samples by their values at valueIx. It returns the interfaces ranked by sample weight,
+// and by their number of implementations for equal weights, together with the total sample weight of
+// the profile.
+func (p *program) hotInterfaces(prof *profile.Profile, valueIx int) ([]*hotInterface, int64) {
+	files := p.filesByProfileName()
+	var total int64
+	sampled := make(map[fileLine]int64)
+	callees := make(map[fileLine]map[string]int64)
+	for _, sample := range prof.Sample {
+		if valueIx >= len(sample.Value) {
+			continue
+		}
+		weight := sample.Value[valueIx]
+		total += weight
+		// flattens the stack including inlined frames, from the leaf to the root
+		var frames []profile.Line
+		for _, loc := range sample.Location {
+			frames = append(frames, loc.Line...)
+		}
+		seen := make(map[fileLine]bool)
+		// the leaf frame is not a call site
+		for i := 1; i < len(frames); i++ {
+			if frames[i].Function == nil || frames[i-1].Function == nil {
+				continue
+			}
+			fp, ok := files[frames[i].Function.Filename]
+			if !ok {
+				continue
+			}
+			fl := fileLine{filepath: fp, row: int(frames[i].Line)}
+			if seen[fl] {
+				continue
+			}
+			seen[fl] = true
+			sampled[fl] += weight
+			if callees[fl] == nil {
+				callees[fl] = make(map[string]int64)
+			}
+			callees[fl][frames[i-1].Function.Name] += weight
+		}
+	}
+
+	hot := make(map[*types.TypeName]*hotInterface)
+	p.eachFile(func(pkg *packages.Package, f *ast.File, fp string) {
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			fl := fileLine{filepath: fp, row: p.fset.Position(sel.Sel.Pos()).Line}
+			weight, ok := sampled[fl]
+			if !ok {
+				return true
+			}
+			selection, ok := pkg.TypesInfo.Selections[sel]
+			if !ok || selection.Kind() != types.MethodVal {
+				return true
+			}
+			named, ok := selection.Recv().(*types.Named)
+			if !ok || !types.IsInterface(named) || !p.inProject(named.Obj()) {
+				return true
+			}
+			// calls in test files refer to the interface as declared in the test variant
+			tn, ok := p.packageObject(named.Obj()).(*types.TypeName)
+			if !ok {
+				return true
+			}
+			h, ok := hot[tn]
+			if !ok {
+				iface := tn.Type().Underlying().(*types.Interface)
+				h = &hotInterface{
+					tn:         tn,
+					iface:      iface,
+					callSites:  make(map[fileLine]bool),
+					implWeight: make(map[*types.TypeName]int64),
+					impls:      p.implementations(iface),
+				}
+				hot[tn] = h
+			}
+			if h.callSites[fl] {
+				return true
+			}
+			h.callSites[fl] = true
+			h.weight += weight
+			for callee, calleeWeight := range callees[fl] {
+				for _, impl := range h.impls {
+					if isMethodOf(callee, impl) {
+						h.implWeight[impl] += calleeWeight
+					}
+				}
+			}
+			return true
+		})
+	})
+	ranked := make([]*hotInterface, 0, len(hot))
+	for _, h := range hot {
+		if len(h.impls) > 0 {
+			ranked = append(ranked, h)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].weight != ranked[j].weight {
+			return ranked[i].weight > ranked[j].weight
+		}
+		return len(ranked[i].impls) < len(ranked[j].impls)
+	})
+	return ranked, total
+}
+
+// filesByProfileName maps the filenames a profile may refer to the project's source files by. Besides
+// the absolute filepath, binaries built with -trimpath refer to the files by their import path.
+func (p *program) filesByProfileName() map[string]string {
+	files := make(map[string]string)
+	for _, pkg := range p.pkgs {
+		for _, fp := range pkg.CompiledGoFiles {
+			files[fp] = fp
+			files[filepath.ToSlash(fp)] = fp
+			files[pkg.PkgPath+"/"+filepath.Base(fp)] = fp
+		}
+	}
+	return files
+}
+
+// inProject reports whether the object obj is declared in one of the project's packages.
+func (p *program) inProject(obj types.Object) bool {
+	if obj.Pkg() == nil {
+		return false
+	}
+	for _, pkg := range p.pkgs {
+		if pkg.Types == obj.Pkg() {
+			return true
+		}
+	}
+	return false
+}
+
+// isMethodOf reports whether the symbol name given by funcName, e.g. example.com/lib.(*impl).M, is a
+// method of the type given by tn.
+func isMethodOf(funcName string, tn *types.TypeName) bool {
+	pkgPath := tn.Pkg().Path()
+	if !strings.HasPrefix(funcName, pkgPath+".") {
+		return false
+	}
+	rest := funcName[len(pkgPath)+1:]
+	return strings.HasPrefix(rest, "(*"+tn.Name()+").") || strings.HasPrefix(rest, tn.Name()+".")
+}
+
+// formatWeight formats the sample weight w in the unit of vt.
+func formatWeight(w int64, vt *profile.ValueType) string {
+	if vt.Unit == "nanoseconds" {
+		return time.Duration(w).String()
+	}
+	return fmt.Sprintf("%d %s", w, vt.Unit)
+}
+
+// printSuggestion prints the noifgo tags to add to the project to optimize the hot interface h.
+func (p *program) printSuggestion(rootFolder string, h *hotInterface) {
+	rel := func(fp string) string {
+		if r, err := filepath.Rel(rootFolder, fp); err == nil {
+			return r
+		}
+		return fp
+	}
+	pos := p.fset.Position(h.tn.Pos())
+	if len(h.impls) > 1 {
+		// the implementation most calls were dispatched to is the likely concrete type
+		likely := h.impls[0]
+		for _, impl := range h.impls {
+			if h.implWeight[impl] > h.implWeight[likely] {
+				likely = impl
+			}
+		}
+		if !hasTag(pos.Filename, pos.Line, ifdefTag) {
+			fmt.Printf("   %s:%d: add //noifgo:ifdef guard impl=%s\n", rel(pos.Filename), pos.Line, likely.Name())
+		}
+		return
+	}
+	if !hasTag(pos.Filename, pos.Line, ifdefTag) {
+		fmt.Printf("   %s:%d: add //noifgo:ifdef\n", rel(pos.Filename), pos.Line)
+	}
+	// untagged references are replaced as configured by default, which needs no tags unless only a pointer
+	// implements the interface but the default is a value, or both do and the default is auto
+	name := h.tn.Name()
+	var tags string
+	switch as := guardAs(h.impls[0], h.iface); {
+	case as == "p" && p.cfg.Default == "v":
+		tags = fmt.Sprintf("//noifgo:{%s,p}", name)
+	case as == "v" && p.cfg.Default == "auto":
+		tags = fmt.Sprintf("//noifgo:{%s,v} or //noifgo:{%s,p}", name, name)
+	default:
+		return
+	}
+	for _, ref := range p.uses(h.tn) {
+		if convertTo, _, err := shouldConvertTo(nil, ref.Filename, ref.Line, name); err != nil || convertTo != "" {
+			continue
+		}
+		fmt.Printf("   %s:%d: add %s\n", rel(ref.Filename), ref.Line, tags)
+	}
+}
+
+// hasTag reports whether the line before row in the file given by fp contains tag.
+func hasTag(fp string, row int, tag []byte) bool {
+	b, err := ioutil.ReadFile(fp)
+	if err != nil || row < 2 {
+		return false
+	}
+	lines := bytes.Split(b, []byte("\n"))
+	if row-2 >= len(lines) {
+		return false
+	}
+	return bytes.Contains(lines[row-2], tag)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const helpVerify = `Usage:
+
+	noifgo verify [go test flags] [packages]
+
+Verify runs "go test" twice, first on the untouched source files and then on the source files with
+every tagged interface rewritten the same way a build does, and reports each test, and each package,
+whose pass or fail status or whose output differs between the two runs. Durations are left out of
+the comparison. The source files are left untouched.
+
+The arguments are passed to both runs of "go test", e.g. noifgo verify -run TestFoo ./foo/...
+Without arguments every package of the project is tested. Tests are always run rather than cached.
+
+Verify exits with status 1 if any difference is found.
+
+`
+
+// elapsedPattern matches the durations go test prints, e.g. the (0.00s) of --- PASS: TestFoo (0.00s).
+var elapsedPattern = regexp.MustCompile(`\s\(?\d+(\.\d+)?s\)?`)
+
+// testKey identifies a test, or a package if test is empty.
+type testKey struct {
+	pkg, test string
+}
+
+// testResult is the outcome of a test or a package in a run of go test.
+type testResult struct {
+	// action is "pass", "fail" or "skip", or empty if the test did not finish
+	action string
+	output []string
+}
+
+// testEvent is an event of the JSON output of go test, see go doc test2json.
+type testEvent struct {
+	Action      string
+	Package     string
+	Test        string
+	Output      string
+	ImportPath  string
+	FailedBuild string
+}
+
+// verify implements the "noifgo verify" command.
+func verify(ctx context.Context, cfg *config, rootFolder string, args []string) error {
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		fmt.Printf(helpVerify)
+		return nil
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		dir = rootFolder
+		args = loadPatterns(ctx, cfg, rootFolder)
+	}
+
+	fmt.Fprintf(os.Stderr, "Testing the original code\n")
+	original, err := runTests(ctx, cfg, dir, nil, nil, args)
+	if err != nil {
+		return err
+	}
+
+	// build errors refer to the rewritten copies of the source files, which the annotator translates
+	r, ann, err := rewriteInOverlay(ctx, cfg, rootFolder, dir)
+	if err != nil {
+		return err
+	}
+	defer r.ov.remove()
+	fmt.Fprintf(os.Stderr, "Testing the rewritten code\n")
+	rewritten, err := runTests(ctx, cfg, dir, r.ov, ann, args)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]testKey, 0, len(original))
+	for key := range original {
+		keys = append(keys, key)
+	}
+	for key := range rewritten {
+		if _, ok := original[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pkg != keys[j].pkg {
+			return keys[i].pkg < keys[j].pkg
+		}
+		// a package precedes its tests
+		return keys[i].test < keys[j].test
+	})
+	differences := 0
+	for _, key := range keys {
+		before, after := original[key], rewritten[key]
+		if report := compareResults(before, after); report != "" {
+			name := key.pkg
+			if key.test != "" {
+				name += " " + key.test
+			}
+			fmt.Printf("%s: %s", name, report)
+			differences++
+		}
+	}
+	if differences > 0 {
+		return fmt.Errorf("%d tests or packages differ between the original and the rewritten code", differences)
+	}
+	fmt.Fprintf(os.Stderr, "No differences found across %d tests and packages\n", len(keys))
+	return nil
+}
+
+// runTests runs go test -json with args in the folder dir, on the source files rewritten in ov if ov
+// is not nil, and returns the outcome of each test and each package tested. The build output is
+// translated by ann unless it is nil. Failing tests are not an error, failing to run go test is.
+func runTests(ctx context.Context, cfg *config, dir string, ov *overlay, ann *annotator, args []string) (map[testKey]*testResult, error) {
+	testArgs := []string{"test", "-json", "-count=1"}
+	if ov != nil {
+		overlayFp, err := ov.writeJSON()
+		if err != nil {
+			return nil, fmt.Errorf("could not write overlay: %s", err)
+		}
+		testArgs = append(testArgs, "-overlay="+overlayFp)
+	}
+	cmd := exec.CommandContext(ctx, cfg.goBinary(), append(testArgs, args...)...)
+	cmd.Dir = dir
+	cmd.Env = cfg.env()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, errors.New("Interrupted")
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return nil, fmt.Errorf("could not run go test: %s", err)
+	}
+
+	results := make(map[testKey]*testResult)
+	// buildOutput holds the output of the failed builds keyed by import path
+	buildOutput := make(map[string][]string)
+	dec := json.NewDecoder(&stdout)
+	for {
+		var e testEvent
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse the output of go test: %s", err)
+		}
+		if e.Action == "build-output" {
+			if ann != nil {
+				e.Output = ann.annotate(e.Output)
+			}
+			// an annotated line is followed by the lines naming its causes
+			buildOutput[e.ImportPath] = append(buildOutput[e.ImportPath], splitLines([]byte(e.Output))...)
+			continue
+		}
+		if e.Package == "" {
+			continue
+		}
+		key := testKey{pkg: e.Package, test: e.Test}
+		res, ok := results[key]
+		if !ok {
+			res = &testResult{}
+			results[key] = res
+		}
+		switch e.Action {
+		case "output":
+			res.output = append(res.output, elapsedPattern.ReplaceAllString(e.Output, ""))
+		case "pass", "fail", "skip":
+			res.action = e.Action
+			if e.FailedBuild != "" {
+				res.output = append(res.output, buildOutput[e.FailedBuild]...)
+			}
+		}
+	}
+	if len(results) == 0 && err != nil {
+		return nil, fmt.Errorf("go test failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	return results, nil
+}
+
+// compareResults returns a report of the differences between the outcome of a test on the original
+// code, before, and on the rewritten code, after, ending with a line feed. Either may be nil if the
+// test did not run. An empty string is returned if the outcomes are the same.
+func compareResults(before, after *testResult) string {
+	var b, a testResult
+	if before != nil {
+		b = *before
+	}
+	if after != nil {
+		a = *after
+	}
+	sameOutput := len(b.output) == len(a.output)
+	for i := 0; sameOutput && i < len(b.output); i++ {
+		sameOutput = b.output[i] == a.output[i]
+	}
+	if before != nil && after != nil && b.action == a.action && sameOutput {
+		return ""
+	}
+	var sb strings.Builder
+	if before == nil || after == nil || b.action != a.action {
+		fmt.Fprintf(&sb, "%s on the original code but %s on the rewritten code\n", outcome(before), outcome(after))
+	} else {
+		fmt.Fprintf(&sb, "%s on both but its output differs\n", outcome(before))
+	}
+	if sameOutput {
+		return sb.String()
+	}
+	for _, e := range diffLines(b.output, a.output) {
+		if e.op == ' ' {
+			continue
+		}
+		fmt.Fprintf(&sb, "\t%c %s", e.op, e.line)
+		if !strings.HasSuffix(e.line, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// outcome describes the outcome of the test res, which is nil if the test did not run.
+func outcome(res *testResult) string {
+	if res == nil {
+		return "does not run"
+	}
+	switch res.action {
+	case "pass":
+		return "passes"
+	case "fail":
+		return "fails"
+	case "skip":
+		return "is skipped"
+	}
+	return "does not finish"
+}